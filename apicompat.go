@@ -0,0 +1,404 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+	"golang.org/x/mod/modfile"
+)
+
+var (
+	ErrInsufficientBump = errors.New("ERROR: the release version doesn't match the API changes.")
+)
+
+// APISurface maps the exported identifiers of a module, e.g. "Func" or "sub/pkg.Type.Method",
+// to their normalized declaration.
+type APISurface map[string]string
+
+type APIChange struct {
+	Name string
+	Old  string
+	New  string
+	// Message describing the change, e.g. "removed"
+	Message string
+}
+
+func (c APIChange) String() string {
+	return fmt.Sprintf("%s: %s", c.Name, c.Message)
+}
+
+type APIDiff struct {
+	Incompatible []APIChange
+	Compatible   []APIChange
+}
+
+// RequiredBump is the smallest release type allowed by the diff, in the spirit of `gorelease`.
+func (d *APIDiff) RequiredBump() ReleaseType {
+	switch {
+	case len(d.Incompatible) > 0:
+		return ReleaseMajor
+	case len(d.Compatible) > 0:
+		return ReleaseMinor
+	default:
+		return ReleasePatch
+	}
+}
+
+// goExportData builds the packages of the module in dir with their dependencies, and returns the export data file
+// of every package by import path.
+func goExportData(dir string) (map[string]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("go", "list", "-export", "-deps", "-f", "{{.ImportPath}}\t{{.Export}}", "./...")
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: could not build the packages in %s: %s: %s", dir, err, strings.TrimSpace(stderr.String()))
+	}
+
+	exports := map[string]string{}
+	for _, line := range splitLines(string(out)) {
+		if importPath, export, ok := strings.Cut(line, "\t"); ok && export != "" {
+			exports[importPath] = export
+		}
+	}
+	return exports, nil
+}
+
+// ExtractAPI type-checks the non-test Go packages of the module in dir, skipping internal, testdata, vendor and nested module directories.
+// Types come from go/types, so inferred ones like `var X = f()` are compared as well. Imports are resolved
+// with `go list -export`, which needs the go toolchain and the module's dependencies.
+func ExtractAPI(dir string) (APISurface, error) {
+	api := APISurface{}
+	fset := token.NewFileSet()
+
+	data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: not a Go module: %s", err)
+	}
+	modulePath := modfile.ModulePath(data)
+
+	exports, err := goExportData(dir)
+	if err != nil {
+		return nil, err
+	}
+	imp := importer.ForCompiler(fset, "gc", func(importPath string) (io.ReadCloser, error) {
+		export, ok := exports[importPath]
+		if !ok {
+			return nil, fmt.Errorf("ERROR: no export data for package: %s", importPath)
+		}
+		return os.Open(export)
+	})
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		name := d.Name()
+		if p != dir {
+			if name == "internal" || name == "testdata" || name == "vendor" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		files := []*ast.File{}
+		for _, entry := range entries {
+			fileName := entry.Name()
+			if entry.IsDir() || !strings.HasSuffix(fileName, ".go") || strings.HasSuffix(fileName, "_test.go") {
+				continue
+			}
+			// files excluded by build constraints would redeclare identifiers
+			if ok, err := build.Default.MatchFile(p, fileName); err != nil || !ok {
+				continue
+			}
+			file, err := parser.ParseFile(fset, filepath.Join(p, fileName), nil, parser.SkipObjectResolution)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		if len(files) == 0 || files[0].Name.Name == "main" {
+			return nil
+		}
+
+		prefix, _ := filepath.Rel(dir, p)
+		prefix = filepath.ToSlash(prefix)
+		importPath := path.Join(modulePath, prefix)
+
+		var typeErrs []error
+		conf := types.Config{Importer: imp, FakeImportC: true, Error: func(err error) { typeErrs = append(typeErrs, err) }}
+		pkg, _ := conf.Check(importPath, fset, files, nil)
+		if len(typeErrs) > 0 {
+			return fmt.Errorf("ERROR: cannot type-check package %s: %s", importPath, errors.Join(typeErrs...))
+		}
+		collectAPI(api, prefix, pkg)
+		return nil
+	})
+
+	return api, err
+}
+
+func collectAPI(api APISurface, prefix string, pkg *types.Package) {
+	key := func(names ...string) string {
+		if prefix == "." {
+			return strings.Join(names, ".")
+		}
+		return prefix + "." + strings.Join(names, ".")
+	}
+	// types of the package itself are unqualified, others use their full import path
+	qualifier := func(p *types.Package) string {
+		if p.Path() == pkg.Path() {
+			return ""
+		}
+		return p.Path()
+	}
+
+	scope := pkg.Scope()
+	for _, name := range scope.Names() {
+		switch obj := scope.Lookup(name).(type) {
+		case *types.Func:
+			if obj.Exported() {
+				api[key(name)] = "func" + signatureString(obj.Type().(*types.Signature), qualifier)
+			}
+		case *types.Var:
+			if obj.Exported() {
+				api[key(name)] = "var " + types.TypeString(obj.Type(), qualifier)
+			}
+		case *types.Const:
+			if obj.Exported() {
+				api[key(name)] = "const " + types.TypeString(obj.Type(), qualifier)
+			}
+		case *types.TypeName:
+			if obj.Exported() {
+				collectType(api, key(name), obj, qualifier)
+			}
+		}
+	}
+}
+
+func collectType(api APISurface, key string, obj *types.TypeName, qualifier types.Qualifier) {
+	if obj.IsAlias() {
+		api[key] = "type = " + types.TypeString(obj.Type(), qualifier)
+		return
+	}
+	named, ok := obj.Type().(*types.Named)
+	if !ok {
+		return
+	}
+	typeParams := typeParamsString(named.TypeParams(), qualifier)
+
+	switch t := named.Underlying().(type) {
+	case *types.Struct:
+		api[key] = "type struct" + typeParams
+		for i := 0; i < t.NumFields(); i++ {
+			field := t.Field(i)
+			if !field.Exported() {
+				continue
+			}
+			if field.Embedded() {
+				api[key+"."+field.Name()] = "embedded " + types.TypeString(field.Type(), qualifier)
+				continue
+			}
+			api[key+"."+field.Name()] = "field " + types.TypeString(field.Type(), qualifier)
+		}
+	case *types.Interface:
+		api[key] = "type interface" + typeParams
+		for i := 0; i < t.NumEmbeddeds(); i++ {
+			api[key+"."+types.TypeString(t.EmbeddedType(i), qualifier)] = "interface embedded"
+		}
+		for i := 0; i < t.NumExplicitMethods(); i++ {
+			method := t.ExplicitMethod(i)
+			api[key+"."+method.Name()] = "interface method" + signatureString(method.Type().(*types.Signature), qualifier)
+		}
+	default:
+		api[key] = "type" + typeParams + " " + types.TypeString(t, qualifier)
+	}
+
+	for i := 0; i < named.NumMethods(); i++ {
+		method := named.Method(i)
+		if method.Exported() {
+			api[key+"."+method.Name()] = "method" + signatureString(method.Type().(*types.Signature), qualifier)
+		}
+	}
+}
+
+func typeParamsString(params *types.TypeParamList, qualifier types.Qualifier) string {
+	if params == nil || params.Len() == 0 {
+		return ""
+	}
+	list := make([]string, 0, params.Len())
+	for i := 0; i < params.Len(); i++ {
+		param := params.At(i)
+		list = append(list, param.Obj().Name()+" "+types.TypeString(param.Constraint(), qualifier))
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+// signatureString prints the parameter and result types, ignoring their names.
+func signatureString(sig *types.Signature, qualifier types.Qualifier) string {
+	tupleTypes := func(tuple *types.Tuple, variadic bool) string {
+		list := make([]string, 0, tuple.Len())
+		for i := 0; i < tuple.Len(); i++ {
+			t := tuple.At(i).Type()
+			if variadic && i == tuple.Len()-1 {
+				list = append(list, "..."+types.TypeString(t.(*types.Slice).Elem(), qualifier))
+				continue
+			}
+			list = append(list, types.TypeString(t, qualifier))
+		}
+		return strings.Join(list, ", ")
+	}
+
+	result := typeParamsString(sig.TypeParams(), qualifier)
+	result += "(" + tupleTypes(sig.Params(), sig.Variadic()) + ")"
+	if results := tupleTypes(sig.Results(), false); results != "" {
+		result += " (" + results + ")"
+	}
+	return result
+}
+
+// CompareAPI lists the changes between two API surfaces. Removing or changing anything is incompatible,
+// and so is adding a method to an interface, since existing implementations no longer satisfy it.
+func CompareAPI(oldAPI, newAPI APISurface) *APIDiff {
+	diff := &APIDiff{}
+
+	for name, oldDecl := range oldAPI {
+		newDecl, ok := newAPI[name]
+		switch {
+		case !ok:
+			diff.Incompatible = append(diff.Incompatible, APIChange{Name: name, Old: oldDecl, Message: "removed"})
+		case oldDecl != newDecl:
+			diff.Incompatible = append(diff.Incompatible, APIChange{Name: name, Old: oldDecl, New: newDecl, Message: fmt.Sprintf("changed from '%s' to '%s'", oldDecl, newDecl)})
+		}
+	}
+
+	for name, newDecl := range newAPI {
+		if _, ok := oldAPI[name]; ok {
+			continue
+		}
+		change := APIChange{Name: name, New: newDecl, Message: "added"}
+		i := strings.LastIndex(name, ".")
+		if i > 0 && strings.HasPrefix(newDecl, "interface") && oldAPI[name[:i]] != "" {
+			change.Message = "added to existing interface"
+			diff.Incompatible = append(diff.Incompatible, change)
+			continue
+		}
+		diff.Compatible = append(diff.Compatible, change)
+	}
+
+	sort.Slice(diff.Incompatible, func(i, j int) bool { return diff.Incompatible[i].Name < diff.Incompatible[j].Name })
+	sort.Slice(diff.Compatible, func(i, j int) bool { return diff.Compatible[i].Name < diff.Compatible[j].Name })
+	return diff
+}
+
+// CheckReleaseBump fails when going from previous to next is a smaller bump than the diff requires.
+func CheckReleaseBump(diff *APIDiff, previous, next string) error {
+	required := diff.RequiredBump()
+
+	pMajor, pMinor, _ := semverParts(previous)
+	nMajor, nMinor, _ := semverParts(next)
+	actual := ReleasePatch
+	switch {
+	case nMajor > pMajor:
+		actual = ReleaseMajor
+	case nMinor > pMinor:
+		actual = ReleaseMinor
+	}
+
+	// v0 makes no compatibility promise, a minor release may break the API, see `gorelease`
+	if pMajor == 0 && nMajor == 0 && required == ReleaseMajor {
+		required = ReleaseMinor
+	}
+
+	if actual < required {
+		changes := diff.Incompatible
+		if len(changes) == 0 {
+			changes = diff.Compatible
+		}
+		lines := make([]string, 0, len(changes))
+		for _, c := range changes {
+			lines = append(lines, c.String())
+		}
+		return fmt.Errorf("%w %s -> %s is a %s release, but the API changes require a %s release:\n%s", ErrInsufficientBump, previous, next, actual, required, strings.Join(lines, "\n"))
+	}
+	return nil
+}
+
+// CheckAPICompatibility compares the exported API of the module in moduleDir ("." for the root) at baseRef
+// (e.g. the last release tag) with the one in repoDir. repoDir must contain the .git directory, and the container needs git and tar.
+// Both versions are type-checked on the host, see ExtractAPI.
+func CheckAPICompatibility(repoDir *dagger.Directory, baseRef string, moduleDir string, container *dagger.Container, c *dagger.Client, ctx context.Context) (*APIDiff, error) {
+	oldDir := container.
+		WithMountedDirectory("/REPO", repoDir).
+		WithWorkdir("/REPO").
+		WithExec([]string{"mkdir", "-p", "/OLD"}).
+		WithExec([]string{"git", "archive", "-o", "/tmp/old.tar", baseRef}).
+		WithExec([]string{"tar", "-x", "-f", "/tmp/old.tar", "-C", "/OLD"}).
+		Directory("/OLD")
+
+	tmp, err := os.MkdirTemp("", "apicompat")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	oldPath := filepath.Join(tmp, "old")
+	newPath := filepath.Join(tmp, "new")
+	if _, err = oldDir.Directory(moduleDir).Export(ctx, oldPath); err != nil {
+		return nil, fmt.Errorf("ERROR: could not export %s: %s", baseRef, err)
+	}
+	if _, err = repoDir.Directory(moduleDir).Export(ctx, newPath); err != nil {
+		return nil, err
+	}
+
+	oldAPI, err := ExtractAPI(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newAPI, err := ExtractAPI(newPath)
+	if err != nil {
+		return nil, err
+	}
+	return CompareAPI(oldAPI, newAPI), nil
+}
+
+// RunAPICompatibilityGate fails a module release whose version bump is smaller than its API changes require.
+func RunAPICompatibilityGate(repoDir *dagger.Directory, release ModuleRelease, container *dagger.Container, c *dagger.Client, ctx context.Context) (*APIDiff, error) {
+	if !release.NewRelease || release.PreviousVersion == "" {
+		return &APIDiff{}, nil
+	}
+
+	diff, err := CheckAPICompatibility(repoDir, release.Module.Tag(release.PreviousVersion), release.Module.Dir, container, c, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return diff, CheckReleaseBump(diff, release.PreviousVersion, release.Version)
+}
@@ -0,0 +1,316 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	issueRefRegex = regexp.MustCompile(`(?:^|[\s(])#(\d+)\b`)
+	// start of a release entry, semantic-release uses "#" headings for minor and major releases
+	changelogEntryRegex = regexp.MustCompile(`(?m)^(<!-- release: |#{1,3} )`)
+)
+
+type ChangelogSectionConfig struct {
+	Type  string
+	Title string
+}
+
+type ChangelogOptions struct {
+	// Used to link commits, issues and pull requests, e.g. https://github.com/jerusj/dagger-pipeline-libs-go
+	RepoURL string
+	// Printf format taking the repo URL and issue number, defaults to "%s/issues/%d"
+	// (GitHub redirects to the pull request when needed). For GitLab use "%s/-/issues/%d".
+	IssueURLFormat string
+	// Printf format taking the repo URL and commit hash, defaults to "%s/commit/%s".
+	CommitURLFormat string
+	// Printf format taking the repo URL, previous and next version, defaults to "%s/compare/%s...%s".
+	CompareURLFormat string
+	// Commit types to list and their titles, in order. Commit types not listed are left out.
+	Sections []ChangelogSectionConfig
+}
+
+func (o ChangelogOptions) withDefaults() ChangelogOptions {
+	if o.IssueURLFormat == "" {
+		o.IssueURLFormat = "%s/issues/%d"
+	}
+	if o.CommitURLFormat == "" {
+		o.CommitURLFormat = "%s/commit/%s"
+	}
+	if o.CompareURLFormat == "" {
+		o.CompareURLFormat = "%s/compare/%s...%s"
+	}
+	if o.Sections == nil {
+		o.Sections = []ChangelogSectionConfig{
+			{Type: "feat", Title: "Features"},
+			{Type: "fix", Title: "Bug Fixes"},
+			{Type: "perf", Title: "Performance Improvements"},
+			{Type: "revert", Title: "Reverts"},
+		}
+	}
+	return o
+}
+
+type IssueReference struct {
+	Number int
+	URL    string
+}
+
+type ChangelogEntry struct {
+	Scope      string
+	Subject    string
+	Hash       string
+	ShortHash  string
+	CommitURL  string
+	References []IssueReference
+	// Only set for breaking changes
+	BreakingNote string
+}
+
+type ChangelogScope struct {
+	// Empty for commits without a scope
+	Name    string
+	Entries []ChangelogEntry
+}
+
+type ChangelogSection struct {
+	Type   string
+	Title  string
+	Scopes []ChangelogScope
+}
+
+type Contributor struct {
+	Name  string
+	Email string
+}
+
+type ReleaseNotes struct {
+	Version         string
+	PreviousVersion string
+	Date            time.Time
+	CompareURL      string
+	Sections        []ChangelogSection
+	Breaking        []ChangelogEntry
+	Contributors    []Contributor
+}
+
+// NewReleaseNotes groups the commits of a release by type and scope.
+func NewReleaseNotes(version, previousVersion string, commits []ConventionalCommit, opts ChangelogOptions) *ReleaseNotes {
+	opts = opts.withDefaults()
+
+	notes := &ReleaseNotes{
+		Version:         version,
+		PreviousVersion: previousVersion,
+		Date:            time.Now().UTC(),
+	}
+	if opts.RepoURL != "" && previousVersion != "" {
+		notes.CompareURL = fmt.Sprintf(opts.CompareURLFormat, opts.RepoURL, previousVersion, version)
+	}
+
+	byType := map[string]map[string][]ChangelogEntry{}
+	seenContributors := map[string]bool{}
+	for _, commit := range commits {
+		if commit.Type == "" {
+			continue
+		}
+
+		entry := newChangelogEntry(commit, opts)
+		if commit.Breaking {
+			breaking := entry
+			breaking.BreakingNote = commit.BreakingNote
+			notes.Breaking = append(notes.Breaking, breaking)
+		}
+
+		if byType[commit.Type] == nil {
+			byType[commit.Type] = map[string][]ChangelogEntry{}
+		}
+		byType[commit.Type][commit.Scope] = append(byType[commit.Type][commit.Scope], entry)
+
+		key := strings.ToLower(commit.AuthorEmail)
+		if key == "" {
+			key = commit.AuthorName
+		}
+		if key != "" && !seenContributors[key] {
+			seenContributors[key] = true
+			notes.Contributors = append(notes.Contributors, Contributor{Name: commit.AuthorName, Email: commit.AuthorEmail})
+		}
+	}
+
+	for _, section := range opts.Sections {
+		scopes := byType[section.Type]
+		if len(scopes) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(scopes))
+		for name := range scopes {
+			names = append(names, name)
+		}
+		// unscoped entries first, then alphabetically
+		sort.Strings(names)
+
+		s := ChangelogSection{Type: section.Type, Title: section.Title}
+		for _, name := range names {
+			s.Scopes = append(s.Scopes, ChangelogScope{Name: name, Entries: scopes[name]})
+		}
+		notes.Sections = append(notes.Sections, s)
+	}
+
+	sort.Slice(notes.Contributors, func(i, j int) bool {
+		return strings.ToLower(notes.Contributors[i].Name) < strings.ToLower(notes.Contributors[j].Name)
+	})
+
+	return notes
+}
+
+func newChangelogEntry(commit ConventionalCommit, opts ChangelogOptions) ChangelogEntry {
+	entry := ChangelogEntry{
+		Scope:   commit.Scope,
+		Subject: commit.Subject,
+		Hash:    commit.Hash,
+	}
+	entry.ShortHash = entry.Hash
+	if len(entry.ShortHash) > 7 {
+		entry.ShortHash = entry.ShortHash[:7]
+	}
+	if opts.RepoURL != "" && commit.Hash != "" {
+		entry.CommitURL = fmt.Sprintf(opts.CommitURLFormat, opts.RepoURL, commit.Hash)
+	}
+
+	// references in the subject, e.g. "(#12)" added by squash merges, and in footers such as "Closes #34"
+	texts := []string{commit.Subject}
+	for _, footer := range commit.Footers {
+		// "Refs #12" is parsed with a bare "12" as value
+		if _, err := strconv.Atoi(footer.Value); err == nil {
+			texts = append(texts, "#"+footer.Value)
+			continue
+		}
+		texts = append(texts, footer.Value)
+	}
+
+	seen := map[int]bool{}
+	for _, text := range texts {
+		for _, m := range issueRefRegex.FindAllStringSubmatch(text, -1) {
+			n, err := strconv.Atoi(m[1])
+			if err != nil || seen[n] {
+				continue
+			}
+			seen[n] = true
+
+			ref := IssueReference{Number: n}
+			if opts.RepoURL != "" {
+				ref.URL = fmt.Sprintf(opts.IssueURLFormat, opts.RepoURL, n)
+			}
+			entry.References = append(entry.References, ref)
+		}
+	}
+
+	return entry
+}
+
+const DefaultReleaseNotesTemplate = `{{define "entry"}}
+* {{if .Scope}}**{{.Scope}}:** {{end}}{{.Subject}}
+{{- range .References}} ({{if .URL}}[#{{.Number}}]({{.URL}}){{else}}#{{.Number}}{{end}}){{end}}
+{{- if .ShortHash}} ({{if .CommitURL}}[{{.ShortHash}}]({{.CommitURL}}){{else}}{{.ShortHash}}{{end}}){{end}}
+{{- end -}}
+## {{if .CompareURL}}[{{.Version}}]({{.CompareURL}}){{else}}{{.Version}}{{end}} ({{.Date.Format "2006-01-02"}})
+{{- if .Breaking}}
+
+### ⚠ BREAKING CHANGES
+{{range .Breaking}}
+* {{if .Scope}}**{{.Scope}}:** {{end}}{{.BreakingNote}}{{end}}
+{{- end}}
+{{- range .Sections}}
+
+### {{.Title}}
+{{range .Scopes}}{{range .Entries}}{{template "entry" .}}{{end}}{{end}}
+{{- end}}
+{{- if .Contributors}}
+
+### Contributors
+{{range .Contributors}}
+* {{.Name}}{{end}}
+{{- end}}
+`
+
+func DefaultReleaseNotesTmpl() *template.Template {
+	return template.Must(template.New("release-notes").Parse(DefaultReleaseNotesTemplate))
+}
+
+// Render executes tmpl against the notes. A nil tmpl uses DefaultReleaseNotesTemplate.
+func (n *ReleaseNotes) Render(tmpl *template.Template) (string, error) {
+	if tmpl == nil {
+		tmpl = DefaultReleaseNotesTmpl()
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, n); err != nil {
+		return "", fmt.Errorf("ERROR: cannot render release notes: %s", err)
+	}
+	return buf.String(), nil
+}
+
+func changelogMarker(version string) string {
+	return fmt.Sprintf("<!-- release: %s -->", version)
+}
+
+const changelogTitle = "# Changelog"
+
+// a level 1 heading of a release, e.g. "# [2.0.0](...)" by semantic-release for major versions, isn't a title
+var changelogReleaseHeadingRegex = regexp.MustCompile(`^# \[?v?[0-9]+\.[0-9]+`)
+
+// changelogHasVersion looks for the marker of version, or a heading like "## [1.2.0](...)" or "## v1.2.0"
+// written by semantic-release or by hand.
+func changelogHasVersion(content, version string) bool {
+	if strings.Contains(content, changelogMarker(version)) {
+		return true
+	}
+	v := regexp.QuoteMeta(strings.TrimPrefix(version, "v"))
+	return regexp.MustCompile(`(?m)^#{1,3} \[?v?` + v + `(\]|[ \t(]|$)`).MatchString(content)
+}
+
+// PrependChangelog adds the rendered notes for version above the newest entry of the changelog at path,
+// keeping its title, any leading level 1 heading like "# CHANGELOG", and any intro text on top.
+// Running it again for the same version leaves the file untouched and returns false.
+func PrependChangelog(path string, version string, rendered string) (bool, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	content := string(existing)
+	if changelogHasVersion(content, version) {
+		return false, nil
+	}
+
+	title, body := changelogTitle, strings.TrimLeft(content, "\n")
+	if line, rest, _ := strings.Cut(body, "\n"); strings.HasPrefix(line, "# ") && !changelogReleaseHeadingRegex.MatchString(line) {
+		title, body = strings.TrimRight(line, " \r"), rest
+	}
+	body = strings.TrimLeft(body, "\n")
+	intro, entries := body, ""
+	if loc := changelogEntryRegex.FindStringIndex(body); loc != nil {
+		intro, entries = body[:loc[0]], body[loc[0]:]
+	}
+	intro = strings.TrimRight(intro, "\n")
+
+	var b strings.Builder
+	b.WriteString(title + "\n\n")
+	if intro != "" {
+		b.WriteString(intro + "\n\n")
+	}
+	b.WriteString(changelogMarker(version) + "\n")
+	b.WriteString(strings.TrimRight(rendered, "\n") + "\n")
+	if entries != "" {
+		b.WriteString("\n" + entries)
+	}
+
+	return true, os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -0,0 +1,149 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+	"github.com/google/go-github/v56/github"
+)
+
+var (
+	ErrNoChangeContext = errors.New("ERROR: cannot determine changed files for this run.")
+)
+
+// PathFilter selects files using the same glob syntax as the `paths` filter of GitHub workflows:
+// `*` matches within a path segment and `**` matches any number of segments.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f PathFilter) Matches(file string) bool {
+	for _, pattern := range f.Exclude {
+		if MatchGlob(pattern, file) {
+			return false
+		}
+	}
+	for _, pattern := range f.Include {
+		if MatchGlob(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f PathFilter) MatchesAny(files []string) bool {
+	for _, file := range files {
+		if f.Matches(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// AffectedPipelines returns the names of the filters matching at least one of the changed files.
+func AffectedPipelines(files []string, filters map[string]PathFilter) map[string]bool {
+	affected := make(map[string]bool, len(filters))
+	for name, filter := range filters {
+		affected[name] = filter.MatchesAny(files)
+	}
+	return affected
+}
+
+func MatchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// collapse repeated '**' segments
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+	return len(name) == 0
+}
+
+func (gha *GitHubActions) ListPullRequestFiles(ctx context.Context, owner string, repo string, prNumber int) (files []string, err error) {
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		commitFiles, resp, err := gha.Client.PullRequests.ListFiles(ctx, owner, repo, prNumber, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range commitFiles {
+			files = append(files, f.GetFilename())
+			// a rename affects both the old and new location
+			if f.GetPreviousFilename() != "" {
+				files = append(files, f.GetPreviousFilename())
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return
+}
+
+// GetChangedFilesFromGit diffs two commits of repoDir, which must contain the .git directory. The container needs git.
+func GetChangedFilesFromGit(repoDir *dagger.Directory, base, head string, container *dagger.Container, c *dagger.Client, ctx context.Context) (files []string, err error) {
+	output, err := gitOutput(repoDir, container, ctx, "git", "diff", "--name-only", base, head)
+	if err != nil {
+		return
+	}
+	return splitLines(output), nil
+}
+
+// GetChangedFiles returns the files changed by the current pull request (via the API) or push (via git).
+// It returns ErrNoChangeContext when that can't be determined, e.g. for local or manually triggered runs.
+func GetChangedFiles(gha *GitHubActions, repoDir *dagger.Directory, container *dagger.Container, c *dagger.Client, ctx context.Context) ([]string, error) {
+	if !IsGitHubActions() {
+		return nil, ErrNoChangeContext
+	}
+
+	ghCtx, err := GetGitHubContext()
+	if err != nil {
+		return nil, err
+	}
+
+	if pr := ghCtx.Event.PullRequest; pr != nil {
+		if gha == nil {
+			return nil, ErrNoChangeContext
+		}
+		return gha.ListPullRequestFiles(ctx, ghCtx.Owner, ghCtx.Repo, pr.Number)
+	}
+
+	// a push creating a new branch has no previous commit to compare against
+	if ghCtx.EventName != "push" || ghCtx.Event.Before == "" || strings.Trim(ghCtx.Event.Before, "0") == "" {
+		return nil, ErrNoChangeContext
+	}
+
+	return GetChangedFilesFromGit(repoDir, ghCtx.Event.Before, ghCtx.Event.After, container, c, ctx)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"log"
 	"os"
@@ -21,6 +22,13 @@ var (
 	flagRelease   = flag.Bool("release", false, "")
 )
 
+// Pipelines are skipped when none of their files changed, see getAffectedPipelines.
+var pipelineFilters = map[string]pipeline.PathFilter{
+	"containers": {Include: []string{"*.go", "go.mod", "go.sum", "ci/**"}, Exclude: []string{"release.go"}},
+	"setup":      {Include: []string{"*.go", "go.mod", "go.sum", "ci/**"}, Exclude: []string{"release.go", "containers.go"}},
+	"release":    {Include: []string{"**"}},
+}
+
 func main() {
 	if err := runPipelines(context.Background()); err != nil {
 		log.Fatal(err)
@@ -47,31 +55,82 @@ func runPipelines(ctx context.Context) (err error) {
 	}
 	defer c.Close()
 
+	affected := getAffectedPipelines(c, ctx)
+
 	eg, gctx := errgroup.WithContext(ctx)
 
-	if *flagContainer || *flagAll {
+	if (*flagContainer || *flagAll) && affected("containers") {
 		eg.Go(func() error {
 			return runContainerPipeline(c, gctx)
 		})
 	}
 
-	if *flagSetup || *flagAll {
+	if (*flagSetup || *flagAll) && affected("setup") {
 		eg.Go(func() error {
 			return runSetupPipeline(c, gctx)
 		})
 	}
 
-	if *flagRelease || *flagAll {
+	if (*flagRelease || *flagAll) && affected("release") {
 		parentDir := getParentDir()
 		repoDir := c.Host().Directory(parentDir, dagger.HostDirectoryOpts{Include: []string{".git", ".releaserc.json"}})
 		eg.Go(func() error {
-			return pipeline.RunSemanticRelease(repoDir, "github", c, gctx)
+			gitContainer := c.Container().From("docker.io/alpine/git:2.36.3").WithEntrypoint([]string{})
+			_, err := pipeline.RunCommitLint(repoDir, "", pipeline.CommitLintOptions{}, pipeline.DetectCIProvider(gctx), gitContainer, c, gctx)
+			if err != nil && !errors.Is(err, pipeline.ErrNoChangeContext) {
+				return err
+			}
+
+			token, err := pipeline.SecretFromEnv("GITHUB_TOKEN", "GITHUB_TOKEN", c)
+			if err != nil {
+				return err
+			}
+			result, err := pipeline.RunSemanticRelease(repoDir, pipeline.SemanticReleaseOptions{
+				Platform: "github",
+				Token:    token,
+				// Always release under CI
+				DryRun: os.Getenv("CI") == "",
+			}, c, gctx)
+			if err != nil {
+				return err
+			}
+			log.Printf("Release: last version '%s', next version '%s', released: %t", result.LastVersion, result.NextVersion, result.Released)
+			return nil
 		})
 	}
 
 	return eg.Wait()
 }
 
+// getAffectedPipelines falls back to running every pipeline when the changed files are unknown.
+func getAffectedPipelines(c *dagger.Client, ctx context.Context) func(name string) bool {
+	runAll := func(string) bool { return true }
+
+	var gha *pipeline.GitHubActions
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		gha = pipeline.NewGitHubActions(ctx, token)
+	}
+
+	repoDir := c.Host().Directory(getParentDir(), dagger.HostDirectoryOpts{Include: []string{".git"}})
+	gitContainer := c.Container().From("docker.io/alpine/git:2.36.3").WithEntrypoint([]string{})
+
+	files, err := pipeline.GetChangedFiles(gha, repoDir, gitContainer, c, ctx)
+	if err != nil {
+		log.Printf("Running all selected pipelines: %s", err)
+		return runAll
+	}
+
+	affected := pipeline.AffectedPipelines(files, pipelineFilters)
+	for name, ok := range affected {
+		if !ok {
+			log.Printf("Skipping pipeline '%s': no matching files changed", name)
+		}
+	}
+	return func(name string) bool {
+		return affected[name]
+	}
+}
+
 func runSetupPipeline(c *dagger.Client, ctx context.Context) (err error) {
 	c = c.Pipeline("Setup")
 
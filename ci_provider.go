@@ -0,0 +1,455 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNotPullRequest = errors.New("ERROR: not running for a pull/merge request.")
+	ErrMissingToken   = errors.New("ERROR: no API token available.")
+)
+
+type AnnotationLevel string
+
+const (
+	AnnotationNotice  AnnotationLevel = "notice"
+	AnnotationWarning AnnotationLevel = "warning"
+	AnnotationError   AnnotationLevel = "error"
+)
+
+type Annotation struct {
+	Level   AnnotationLevel
+	File    string
+	Line    int
+	Title   string
+	Message string
+}
+
+// CIProvider hides the differences between CI platforms, so pipelines run unchanged on each of them.
+type CIProvider interface {
+	// One of "github", "gitlab", "bitbucket" (as accepted by RunSemanticRelease) or "local".
+	Name() string
+	IsPullRequest() bool
+	// PullRequestNumber is the PR/MR number, or 0 outside of pull/merge requests.
+	PullRequestNumber() int
+	CommitSHA() string
+	Branch() string
+	// Ref is the fully qualified ref of CommitSHA, e.g. "refs/heads/main" or "refs/tags/v1.0.0", or "" if unknown.
+	Ref() string
+	RepositoryURL() string
+	BuildURL() string
+	SetOutput(name, value string) error
+	Annotate(a Annotation) error
+	// Summary publishes the report of the job, e.g. as the GitHub step summary.
+	Summary(report *Report) error
+	// Comment creates or updates the pull/merge request comment containing identifier.
+	Comment(ctx context.Context, body, identifier string) error
+}
+
+// DetectCIProvider picks the provider from the environment, falling back to LocalProvider.
+func DetectCIProvider(ctx context.Context) CIProvider {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return NewGitHubActionsProvider(ctx)
+	case os.Getenv("GITLAB_CI") == "true":
+		return NewGitLabCIProvider()
+	case os.Getenv("BITBUCKET_BUILD_NUMBER") != "":
+		return NewBitbucketPipelinesProvider()
+	default:
+		return &LocalProvider{}
+	}
+}
+
+// GitHub Actions
+
+type GitHubActionsProvider struct {
+	Context *GitHubContext
+	// nil when GITHUB_TOKEN isn't set
+	Client *GitHubActions
+}
+
+func NewGitHubActionsProvider(ctx context.Context) *GitHubActionsProvider {
+	ghCtx, err := GetGitHubContext()
+	if err != nil {
+		log.Printf("WARNING: %s", err)
+	}
+
+	p := &GitHubActionsProvider{Context: ghCtx}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		p.Client = NewGitHubActions(ctx, token)
+	}
+	return p
+}
+
+func (p *GitHubActionsProvider) Name() string { return "github" }
+
+func (p *GitHubActionsProvider) IsPullRequest() bool {
+	return p.Context.Event.PullRequest != nil
+}
+
+func (p *GitHubActionsProvider) PullRequestNumber() int {
+	if pr := p.Context.Event.PullRequest; pr != nil {
+		return pr.Number
+	}
+	return 0
+}
+
+func (p *GitHubActionsProvider) CommitSHA() string {
+	// GITHUB_SHA is the merge commit for pull requests
+	if pr := p.Context.Event.PullRequest; pr != nil && pr.Head.SHA != "" {
+		return pr.Head.SHA
+	}
+	return p.Context.SHA
+}
+
+func (p *GitHubActionsProvider) Branch() string {
+	if p.Context.HeadRef != "" {
+		return p.Context.HeadRef
+	}
+	return strings.TrimPrefix(p.Context.Ref, "refs/heads/")
+}
+
+func (p *GitHubActionsProvider) Ref() string {
+	// GITHUB_REF is the merge ref for pull requests, CommitSHA is on the head branch
+	if p.Context.HeadRef != "" {
+		return "refs/heads/" + p.Context.HeadRef
+	}
+	return p.Context.Ref
+}
+
+func (p *GitHubActionsProvider) RepositoryURL() string {
+	return fmt.Sprintf("%s/%s", p.Context.ServerURL, p.Context.Repository)
+}
+
+func (p *GitHubActionsProvider) BuildURL() string {
+	return fmt.Sprintf("%s/%s/actions/runs/%d", p.Context.ServerURL, p.Context.Repository, p.Context.RunID)
+}
+
+// SetOutput writes to $GITHUB_OUTPUT, falling back to the deprecated set-output command.
+func (p *GitHubActionsProvider) SetOutput(name, value string) error {
+	outputPath := os.Getenv("GITHUB_OUTPUT")
+	if outputPath == "" {
+		AddGithubOutputShell(name, value)
+		return nil
+	}
+
+	delimiter, err := randomDelimiter()
+	if err != nil {
+		return err
+	}
+	return appendToFile(outputPath, fmt.Sprintf("%s<<%s\n%s\n%s\n", name, delimiter, value, delimiter))
+}
+
+func (p *GitHubActionsProvider) Summary(report *Report) error {
+	return WriteGitHubStepSummary(report)
+}
+
+// See: https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions#setting-an-error-message
+func (p *GitHubActionsProvider) Annotate(a Annotation) error {
+	props := []string{}
+	if a.File != "" {
+		props = append(props, "file="+escapeWorkflowProperty(a.File))
+	}
+	if a.Line > 0 {
+		props = append(props, fmt.Sprintf("line=%d", a.Line))
+	}
+	if a.Title != "" {
+		props = append(props, "title="+escapeWorkflowProperty(a.Title))
+	}
+
+	cmd := "::" + string(a.Level)
+	if len(props) > 0 {
+		cmd += " " + strings.Join(props, ",")
+	}
+	fmt.Fprintf(os.Stdout, "%s::%s\n", cmd, escapeWorkflowData(a.Message))
+	return nil
+}
+
+func (p *GitHubActionsProvider) Comment(ctx context.Context, body, identifier string) error {
+	if !p.IsPullRequest() {
+		return ErrNotPullRequest
+	}
+	if p.Client == nil {
+		return ErrMissingToken
+	}
+	return p.Client.CommentOrUpdatePR(ctx, p.Context.Owner, p.Context.Repo, p.PullRequestNumber(), body, identifier)
+}
+
+func escapeWorkflowData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+func escapeWorkflowProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// GitLab CI
+// See: https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+
+type GitLabCIProvider struct {
+	Context *GitLabContext
+	// nil when neither GITLAB_TOKEN nor CI_JOB_TOKEN are set
+	Client *GitLab
+	// Dotenv file for `artifacts:reports:dotenv`, defaults to "pipeline.env".
+	OutputFile string
+	// Markdown file for the reports, to keep as an artifact, defaults to "pipeline-summary.md".
+	SummaryFile string
+}
+
+func NewGitLabCIProvider() *GitLabCIProvider {
+	p := &GitLabCIProvider{
+		Context:     GetGitLabContext(),
+		OutputFile:  "pipeline.env",
+		SummaryFile: "pipeline-summary.md",
+	}
+	if client, err := NewGitLabFromEnv(); err == nil {
+		p.Client = client
+	}
+	return p
+}
+
+func (p *GitLabCIProvider) Name() string           { return "gitlab" }
+func (p *GitLabCIProvider) IsPullRequest() bool    { return p.Context.MergeRequestIID != 0 }
+func (p *GitLabCIProvider) PullRequestNumber() int { return p.Context.MergeRequestIID }
+func (p *GitLabCIProvider) CommitSHA() string      { return p.Context.SHA }
+func (p *GitLabCIProvider) RepositoryURL() string  { return p.Context.ProjectURL }
+func (p *GitLabCIProvider) BuildURL() string       { return p.Context.PipelineURL }
+
+func (p *GitLabCIProvider) Branch() string {
+	if p.Context.SourceBranch != "" {
+		return p.Context.SourceBranch
+	}
+	return p.Context.RefName
+}
+
+func (p *GitLabCIProvider) Ref() string {
+	if p.Context.CommitTag != "" {
+		return "refs/tags/" + p.Context.CommitTag
+	}
+	if branch := p.Branch(); branch != "" {
+		return "refs/heads/" + branch
+	}
+	return ""
+}
+
+func (p *GitLabCIProvider) SetOutput(name, value string) error {
+	return appendDotenv(p.OutputFile, name, value)
+}
+
+// GitLab has no annotations, so they're only logged.
+func (p *GitLabCIProvider) Annotate(a Annotation) error {
+	logAnnotation(a)
+	return nil
+}
+
+// GitLab has no job summaries, so the report is logged and appended to SummaryFile.
+func (p *GitLabCIProvider) Summary(report *Report) error {
+	return writeSummaryFile(p.SummaryFile, report)
+}
+
+func (p *GitLabCIProvider) Comment(ctx context.Context, body, identifier string) error {
+	if !p.IsPullRequest() {
+		return ErrNotPullRequest
+	}
+	if p.Client == nil {
+		return ErrMissingToken
+	}
+	return p.Client.CommentOrUpdateMR(ctx, p.Context.ProjectID, p.Context.MergeRequestIID, body, identifier)
+}
+
+// Bitbucket Pipelines
+// See: https://support.atlassian.com/bitbucket-cloud/docs/variables-and-secrets/
+
+type BitbucketPipelinesProvider struct {
+	Workspace   string
+	RepoSlug    string
+	PRID        int
+	SHA         string
+	BranchName  string
+	Tag         string
+	BuildNumber string
+	Token       string
+	// Dotenv file to pass on as an artifact, defaults to "pipeline.env".
+	OutputFile string
+	// Markdown file for the reports, to keep as an artifact, defaults to "pipeline-summary.md".
+	SummaryFile string
+}
+
+func NewBitbucketPipelinesProvider() *BitbucketPipelinesProvider {
+	p := &BitbucketPipelinesProvider{
+		Workspace:   os.Getenv("BITBUCKET_WORKSPACE"),
+		RepoSlug:    os.Getenv("BITBUCKET_REPO_SLUG"),
+		SHA:         os.Getenv("BITBUCKET_COMMIT"),
+		BranchName:  os.Getenv("BITBUCKET_BRANCH"),
+		Tag:         os.Getenv("BITBUCKET_TAG"),
+		BuildNumber: os.Getenv("BITBUCKET_BUILD_NUMBER"),
+		Token:       os.Getenv("BITBUCKET_TOKEN"),
+		OutputFile:  "pipeline.env",
+		SummaryFile: "pipeline-summary.md",
+	}
+	p.PRID, _ = strconv.Atoi(os.Getenv("BITBUCKET_PR_ID"))
+	return p
+}
+
+func (p *BitbucketPipelinesProvider) Name() string           { return "bitbucket" }
+func (p *BitbucketPipelinesProvider) IsPullRequest() bool    { return p.PRID != 0 }
+func (p *BitbucketPipelinesProvider) PullRequestNumber() int { return p.PRID }
+func (p *BitbucketPipelinesProvider) CommitSHA() string      { return p.SHA }
+func (p *BitbucketPipelinesProvider) Branch() string         { return p.BranchName }
+
+func (p *BitbucketPipelinesProvider) Ref() string {
+	switch {
+	case p.Tag != "":
+		return "refs/tags/" + p.Tag
+	case p.BranchName != "":
+		return "refs/heads/" + p.BranchName
+	}
+	return ""
+}
+
+func (p *BitbucketPipelinesProvider) RepositoryURL() string {
+	return fmt.Sprintf("https://bitbucket.org/%s/%s", p.Workspace, p.RepoSlug)
+}
+
+func (p *BitbucketPipelinesProvider) BuildURL() string {
+	return fmt.Sprintf("%s/pipelines/results/%s", p.RepositoryURL(), p.BuildNumber)
+}
+
+func (p *BitbucketPipelinesProvider) SetOutput(name, value string) error {
+	return appendDotenv(p.OutputFile, name, value)
+}
+
+// Bitbucket only supports annotations through its reports API, so they're only logged.
+func (p *BitbucketPipelinesProvider) Annotate(a Annotation) error {
+	logAnnotation(a)
+	return nil
+}
+
+// Bitbucket has no build summaries, so the report is logged and appended to SummaryFile.
+func (p *BitbucketPipelinesProvider) Summary(report *Report) error {
+	return writeSummaryFile(p.SummaryFile, report)
+}
+
+func (p *BitbucketPipelinesProvider) Comment(ctx context.Context, body, identifier string) error {
+	if !p.IsPullRequest() {
+		return ErrNotPullRequest
+	}
+	if p.Token == "" {
+		return ErrMissingToken
+	}
+
+	commentsURL := fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%s/%s/pullrequests/%d/comments", p.Workspace, p.RepoSlug, p.PRID)
+	headers := map[string]string{"Authorization": "Bearer " + p.Token}
+
+	comment := map[string]interface{}{"content": map[string]string{"raw": body}}
+	// pages are linked through "next", which is absent on the last page
+	for pageURL := commentsURL + "?pagelen=100"; pageURL != ""; {
+		var comments struct {
+			Values []struct {
+				ID      int64 `json:"id"`
+				Content struct {
+					Raw string `json:"raw"`
+				} `json:"content"`
+			} `json:"values"`
+			Next string `json:"next"`
+		}
+		err := DoJSONRequest(ctx, nil, http.MethodGet, pageURL, headers, nil, &comments)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range comments.Values {
+			if strings.Contains(c.Content.Raw, identifier) {
+				return DoJSONRequest(ctx, nil, http.MethodPut, fmt.Sprintf("%s/%d", commentsURL, c.ID), headers, comment, nil)
+			}
+		}
+		pageURL = comments.Next
+	}
+	return DoJSONRequest(ctx, nil, http.MethodPost, commentsURL, headers, comment, nil)
+}
+
+// Local
+
+// LocalProvider is used outside of CI: outputs, annotations and comments are only printed.
+type LocalProvider struct{}
+
+func (p *LocalProvider) Name() string           { return "local" }
+func (p *LocalProvider) IsPullRequest() bool    { return false }
+func (p *LocalProvider) PullRequestNumber() int { return 0 }
+func (p *LocalProvider) CommitSHA() string      { return "" }
+func (p *LocalProvider) Branch() string         { return "" }
+func (p *LocalProvider) Ref() string            { return "" }
+func (p *LocalProvider) RepositoryURL() string  { return "" }
+func (p *LocalProvider) BuildURL() string       { return "" }
+
+func (p *LocalProvider) SetOutput(name, value string) error {
+	log.Printf("Output: %s=%s", name, value)
+	return nil
+}
+
+func (p *LocalProvider) Annotate(a Annotation) error {
+	logAnnotation(a)
+	return nil
+}
+
+func (p *LocalProvider) Summary(report *Report) error {
+	log.Printf("Summary:\n%s", report.Render(MaxStepSummarySize))
+	return nil
+}
+
+func (p *LocalProvider) Comment(ctx context.Context, body, identifier string) error {
+	log.Printf("Comment (%s):\n%s", identifier, body)
+	return nil
+}
+
+func logAnnotation(a Annotation) {
+	location := a.File
+	if a.Line > 0 {
+		location = fmt.Sprintf("%s:%d", a.File, a.Line)
+	}
+	log.Printf("%s: %s %s %s", strings.ToUpper(string(a.Level)), location, a.Title, a.Message)
+}
+
+func writeSummaryFile(path string, report *Report) error {
+	summary := report.Render(MaxStepSummarySize)
+	log.Printf("Summary:\n%s", summary)
+	if path == "" {
+		return nil
+	}
+	return appendToFile(path, summary)
+}
+
+func appendDotenv(path, name, value string) error {
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("ERROR: multi-line values are not supported in dotenv outputs, output: %s", name)
+	}
+	return appendToFile(path, fmt.Sprintf("%s=%s\n", name, value))
+}
+
+func appendToFile(path, content string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	return err
+}
+
+func randomDelimiter() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ghadelimiter_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+var (
+	ErrCommitLintFailed = errors.New("ERROR: commit messages don't follow the conventions.")
+)
+
+// DefaultCommitTypes are the types of the conventional commits config, see @commitlint/config-conventional.
+var DefaultCommitTypes = []string{"build", "chore", "ci", "docs", "feat", "fix", "perf", "refactor", "revert", "style", "test"}
+
+type CommitLintOptions struct {
+	// Defaults to DefaultCommitTypes
+	Types []string
+	// Allowed scopes, any scope when empty
+	Scopes       []string
+	RequireScope bool
+	// Defaults to 100, negative disables the check
+	MaxHeaderLength       int
+	RequireIssueReference bool
+	// Defaults to GitHub style "#123" and Jira style "ABC-123" references
+	IssuePattern string
+	// Headers matching one of these are skipped. Defaults to git generated reverts, fixups and squashes.
+	IgnorePatterns []string
+}
+
+func (o CommitLintOptions) withDefaults() CommitLintOptions {
+	if len(o.Types) == 0 {
+		o.Types = DefaultCommitTypes
+	}
+	if o.MaxHeaderLength == 0 {
+		o.MaxHeaderLength = 100
+	}
+	if o.IssuePattern == "" {
+		o.IssuePattern = `#\d+|\b[A-Z][A-Z0-9]+-\d+\b`
+	}
+	if o.IgnorePatterns == nil {
+		o.IgnorePatterns = []string{`^Revert "`, `^(fixup|squash|amend)! `}
+	}
+	return o
+}
+
+type CommitLintViolation struct {
+	Commit ConventionalCommit
+	// e.g. "type-enum" or "header-max-length", named after the commitlint rules
+	Rule    string
+	Message string
+}
+
+type CommitLintResult struct {
+	Commits    []ConventionalCommit
+	Skipped    []ConventionalCommit
+	Violations []CommitLintViolation
+}
+
+func (r *CommitLintResult) Passed() bool {
+	return len(r.Violations) == 0
+}
+
+// Report lists the violations as a table, for the step summary or a PR comment.
+func (r *CommitLintResult) Report() *Report {
+	report := NewReport("Commit Lint")
+	if r.Passed() {
+		return report.Status(StatusSuccess, fmt.Sprintf("%d commits follow the conventions.", len(r.Commits)))
+	}
+
+	rows := make([][]string, 0, len(r.Violations))
+	for _, v := range r.Violations {
+		rows = append(rows, []string{shortHash(v.Commit.Hash), v.Commit.Header, v.Rule, v.Message})
+	}
+	return report.
+		Status(StatusFailure, fmt.Sprintf("%d violations in %d commits.", len(r.Violations), len(r.Commits))).
+		Table([]string{"Commit", "Header", "Rule", "Problem"}, rows)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lintCommit checks a single commit against the options, which must already have their defaults.
+func lintCommit(commit ConventionalCommit, opts CommitLintOptions, issueRegex *regexp.Regexp) (violations []CommitLintViolation) {
+	violation := func(rule, format string, args ...interface{}) {
+		violations = append(violations, CommitLintViolation{Commit: commit, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if opts.MaxHeaderLength > 0 && len([]rune(commit.Header)) > opts.MaxHeaderLength {
+		violation("header-max-length", "header is %d characters, the limit is %d", len([]rune(commit.Header)), opts.MaxHeaderLength)
+	}
+
+	if commit.Type == "" {
+		violation("header-format", "header must look like 'type(scope): subject'")
+		return
+	}
+	// Type is lowercased by ParseConventionalCommit, check the header as written
+	if m := conventionalHeaderRegex.FindStringSubmatch(commit.Header); m != nil && m[1] != strings.ToLower(m[1]) {
+		violation("type-case", "type '%s' must be lower-case", m[1])
+	}
+	if !containsString(opts.Types, commit.Type) {
+		violation("type-enum", "type '%s' is not one of: %s", commit.Type, strings.Join(opts.Types, ", "))
+	}
+	switch {
+	case commit.Scope == "" && opts.RequireScope:
+		violation("scope-empty", "a scope is required")
+	case commit.Scope != "" && len(opts.Scopes) > 0:
+		for _, scope := range strings.Split(commit.Scope, ",") {
+			if !containsString(opts.Scopes, strings.TrimSpace(scope)) {
+				violation("scope-enum", "scope '%s' is not one of: %s", scope, strings.Join(opts.Scopes, ", "))
+			}
+		}
+	}
+	if strings.TrimSpace(commit.Subject) == "" {
+		violation("subject-empty", "the subject is empty")
+	}
+	if opts.RequireIssueReference && !issueRegex.MatchString(commit.Message) {
+		violation("references-empty", "no issue reference matching '%s'", opts.IssuePattern)
+	}
+	return
+}
+
+// LintCommits checks the commits against Conventional Commits and the options.
+func LintCommits(commits []ConventionalCommit, opts CommitLintOptions) (*CommitLintResult, error) {
+	opts = opts.withDefaults()
+
+	issueRegex, err := regexp.Compile(opts.IssuePattern)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid issue pattern: %s", err)
+	}
+	ignores := make([]*regexp.Regexp, 0, len(opts.IgnorePatterns))
+	for _, p := range opts.IgnorePatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: invalid ignore pattern: %s", err)
+		}
+		ignores = append(ignores, re)
+	}
+
+	result := &CommitLintResult{}
+commits:
+	for _, commit := range commits {
+		for _, re := range ignores {
+			if re.MatchString(commit.Header) {
+				result.Skipped = append(result.Skipped, commit)
+				continue commits
+			}
+		}
+		result.Commits = append(result.Commits, commit)
+		result.Violations = append(result.Violations, lintCommit(commit, opts, issueRegex)...)
+	}
+	return result, nil
+}
+
+// CommitRangeFromCI returns the base..head range of the current pull/merge request or push.
+// It returns ErrNoChangeContext when that can't be determined, e.g. for local runs.
+func CommitRangeFromCI() (string, error) {
+	isZero := func(sha string) bool { return strings.Trim(sha, "0") == "" }
+
+	switch {
+	case IsGitHubActions():
+		ghCtx, err := GetGitHubContext()
+		if err != nil {
+			return "", err
+		}
+		if pr := ghCtx.Event.PullRequest; pr != nil {
+			return pr.Base.SHA + ".." + pr.Head.SHA, nil
+		}
+		if ghCtx.EventName == "push" && !isZero(ghCtx.Event.Before) {
+			return ghCtx.Event.Before + ".." + ghCtx.Event.After, nil
+		}
+	case os.Getenv("GITLAB_CI") != "":
+		head := os.Getenv("CI_COMMIT_SHA")
+		if base := os.Getenv("CI_MERGE_REQUEST_DIFF_BASE_SHA"); base != "" {
+			return base + ".." + head, nil
+		}
+		if before := os.Getenv("CI_COMMIT_BEFORE_SHA"); !isZero(before) {
+			return before + ".." + head, nil
+		}
+	case os.Getenv("BITBUCKET_BUILD_NUMBER") != "":
+		if base := os.Getenv("BITBUCKET_PR_DESTINATION_COMMIT"); base != "" {
+			return base + ".." + os.Getenv("BITBUCKET_COMMIT"), nil
+		}
+	}
+	return "", ErrNoChangeContext
+}
+
+// RunCommitLint lints the commits of revRange, or of CommitRangeFromCI when empty, skipping merges.
+// Violations are reported as annotations and in the summary of the provider, a nil provider is a LocalProvider.
+// repoDir must contain the .git directory with the history of the range, and the container needs git.
+// If the base commit of the CI range isn't in repoDir, e.g. in a shallow clone, it returns ErrNoChangeContext.
+func RunCommitLint(repoDir *dagger.Directory, revRange string, opts CommitLintOptions, provider CIProvider, container *dagger.Container, c *dagger.Client, ctx context.Context) (*CommitLintResult, error) {
+	if provider == nil {
+		provider = &LocalProvider{}
+	}
+	if revRange == "" {
+		var err error
+		if revRange, err = CommitRangeFromCI(); err != nil {
+			return nil, err
+		}
+		base, _, _ := strings.Cut(revRange, "..")
+		output, err := gitOutput(repoDir, container, ctx, "sh", "-c", `git cat-file -e "$1^{commit}" 2>/dev/null && echo found || echo missing`, "sh", base)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(output) != "found" {
+			return nil, fmt.Errorf("%w: base commit %s is not in the clone, fetch the full history", ErrNoChangeContext, base)
+		}
+	}
+
+	commits, err := GetCommits(repoDir, revRange, container, c, ctx, "--no-merges")
+	if err != nil {
+		return nil, err
+	}
+	result, err := LintCommits(commits, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range result.Violations {
+		err = provider.Annotate(Annotation{
+			Level:   AnnotationError,
+			Title:   fmt.Sprintf("Commit %s: %s", shortHash(v.Commit.Hash), v.Rule),
+			Message: fmt.Sprintf("%s\n%s", v.Commit.Header, v.Message),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = provider.Summary(result.Report()); err != nil {
+		return nil, err
+	}
+
+	if !result.Passed() {
+		return result, fmt.Errorf("%w %d violations in %s", ErrCommitLintFailed, len(result.Violations), revRange)
+	}
+	return result, nil
+}
@@ -0,0 +1,341 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+var (
+	ErrNoMatchingVersion        = errors.New("ERROR: no version matches the constraint.")
+	ErrInvalidVersionConstraint = errors.New("ERROR: invalid version constraint.")
+)
+
+// NoMatchingVersionError is returned when a selector leaves no versions, errors.Is(err, ErrNoMatchingVersion) holds for it.
+type NoMatchingVersionError struct {
+	Selector   VersionSelector
+	Candidates int
+}
+
+func (e *NoMatchingVersionError) Error() string {
+	return fmt.Sprintf("%s constraint: '%s', excludes: %v, candidates: %d", ErrNoMatchingVersion, e.Selector.Constraint, e.Selector.Exclude, e.Candidates)
+}
+
+func (e *NoMatchingVersionError) Is(target error) bool {
+	return target == ErrNoMatchingVersion
+}
+
+type versionComparator struct {
+	op      string
+	version string
+}
+
+func (cmp versionComparator) check(v string) bool {
+	c := semver.Compare(v, cmp.version)
+	switch cmp.op {
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	case "!=":
+		return c != 0
+	default:
+		return c == 0
+	}
+}
+
+// VersionConstraint is a set of alternatives separated by "||", each a list of comparators that must all hold.
+// Supported: >=, >, <=, <, =, !=, ~ (patch updates), ^ (no major updates), and partial versions like 1.28 or 1.28.x.
+// The operator may be separated from its version by spaces, e.g. ">= 1.27".
+type VersionConstraint struct {
+	raw          string
+	alternatives [][]versionComparator
+}
+
+func (vc *VersionConstraint) String() string {
+	return vc.raw
+}
+
+// ParseVersionConstraint parses constraint, an empty one matches every version.
+func ParseVersionConstraint(constraint string) (*VersionConstraint, error) {
+	vc := &VersionConstraint{raw: constraint}
+	if strings.TrimSpace(constraint) == "" {
+		vc.alternatives = [][]versionComparator{{}}
+		return vc, nil
+	}
+
+	for _, alt := range strings.Split(constraint, "||") {
+		fields := strings.Fields(strings.ReplaceAll(alt, ",", " "))
+		// an empty alternative would match every version
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%w '%s': empty alternative", ErrInvalidVersionConstraint, constraint)
+		}
+
+		comparators := []versionComparator{}
+		for i := 0; i < len(fields); i++ {
+			field := fields[i]
+			// an operator separated from its version, e.g. ">= 1.27"
+			if strings.Trim(field, "<>=!~^") == "" && i+1 < len(fields) {
+				i++
+				field += fields[i]
+			}
+			parsed, err := parseComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("%w '%s': %s", ErrInvalidVersionConstraint, constraint, err)
+			}
+			comparators = append(comparators, parsed...)
+		}
+		vc.alternatives = append(vc.alternatives, comparators)
+	}
+	return vc, nil
+}
+
+// parseComparator expands one comparator into simple comparisons against full versions.
+func parseComparator(s string) ([]versionComparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			break
+		}
+	}
+	version := strings.TrimSpace(strings.TrimPrefix(s, op))
+	if version == "*" || strings.EqualFold(version, "x") {
+		return nil, nil
+	}
+
+	parts, rest, err := partialVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	n := len(parts)
+	if n < 3 {
+		parts = append(parts, make([]int, 3-n)...)
+	}
+	lower := fmt.Sprintf("v%d.%d.%d%s", parts[0], parts[1], parts[2], rest)
+
+	// upper bound of the range of a partial version, e.g. 1.28 -> 1.29.0
+	next := func(level int) string {
+		switch level {
+		case 0:
+			return fmt.Sprintf("v%d.0.0-0", parts[0]+1)
+		case 1:
+			return fmt.Sprintf("v%d.%d.0-0", parts[0], parts[1]+1)
+		default:
+			return fmt.Sprintf("v%d.%d.%d-0", parts[0], parts[1], parts[2]+1)
+		}
+	}
+
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []versionComparator{{"=", lower}}, nil
+		}
+		return []versionComparator{{">=", lower}, {"<", next(n - 1)}}, nil
+	case "!=":
+		if n == 3 {
+			return []versionComparator{{"!=", lower}}, nil
+		}
+		// a partial version excludes its whole range, which needs an alternative; keep it simple and reject it
+		return nil, fmt.Errorf("'!=' needs a full version, use VersionSelector.Exclude for ranges")
+	case ">=", "<":
+		return []versionComparator{{op, lower}}, nil
+	case ">":
+		if n == 3 {
+			return []versionComparator{{">", lower}}, nil
+		}
+		return []versionComparator{{">=", next(n - 1)}}, nil
+	case "<=":
+		if n == 3 {
+			return []versionComparator{{"<=", lower}}, nil
+		}
+		return []versionComparator{{"<", next(n - 1)}}, nil
+	case "~":
+		if n == 1 {
+			return []versionComparator{{">=", lower}, {"<", next(0)}}, nil
+		}
+		return []versionComparator{{">=", lower}, {"<", next(1)}}, nil
+	case "^":
+		switch {
+		case parts[0] > 0 || n == 1:
+			return []versionComparator{{">=", lower}, {"<", next(0)}}, nil
+		case parts[1] > 0 || n == 2:
+			return []versionComparator{{">=", lower}, {"<", next(1)}}, nil
+		default:
+			return []versionComparator{{">=", lower}, {"<", next(2)}}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operator in '%s'", s)
+}
+
+// partialVersion parses "1", "v1.28", "1.28.x" or "1.28.3-rc.1" into its numbers and the prerelease/build suffix.
+func partialVersion(s string) (parts []int, rest string, err error) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s, rest = s[:i], s[i:]
+	}
+	for _, p := range strings.Split(s, ".") {
+		if p == "x" || p == "X" || p == "*" {
+			break
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version '%s'", s)
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) == 0 || len(parts) > 3 {
+		return nil, "", fmt.Errorf("invalid version '%s'", s)
+	}
+	if rest != "" && len(parts) < 3 {
+		return nil, "", fmt.Errorf("prerelease without a full version '%s'", s)
+	}
+	return parts, rest, nil
+}
+
+// Check reports whether the semver version (with or without "v") satisfies the constraint.
+func (vc *VersionConstraint) Check(version string) bool {
+	v := normalizeVersion(version)
+	if v == "" {
+		return false
+	}
+	for _, alt := range vc.alternatives {
+		ok := true
+		for _, cmp := range alt {
+			if !cmp.check(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeVersion(version string) string {
+	v := version
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	if !semver.IsValid(v) {
+		return ""
+	}
+	return semver.Canonical(v)
+}
+
+// VersionSelector declares which versions of a tag list to use, e.g. for a version matrix.
+type VersionSelector struct {
+	// e.g. ">=1.27 <1.30", "~1.28" or "^2 || ^3"; empty matches everything.
+	Constraint string
+	// Versions or constraints to leave out, e.g. "1.28.1" or "~1.29.0"
+	Exclude []string
+	// Only the latest patch of each of the last LatestMinors minor versions, when set.
+	LatestMinors int
+	// Only the last N versions, after the other rules, when set.
+	Limit             int
+	IncludePrerelease bool
+}
+
+// ResolveVersions returns the versions matching the selector in ascending order, keeping their original spelling.
+func ResolveVersions(versions []string, sel VersionSelector) ([]string, error) {
+	constraint, err := ParseVersionConstraint(sel.Constraint)
+	if err != nil {
+		return nil, err
+	}
+	excludes := make([]*VersionConstraint, 0, len(sel.Exclude))
+	for _, e := range sel.Exclude {
+		vc, err := ParseVersionConstraint(e)
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, vc)
+	}
+
+	matched := []string{}
+	for _, v := range versions {
+		canonical := normalizeVersion(v)
+		if canonical == "" || (!sel.IncludePrerelease && semver.Prerelease(canonical) != "") {
+			continue
+		}
+		if !constraint.Check(v) {
+			continue
+		}
+		excluded := false
+		for _, e := range excludes {
+			if e.Check(v) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			matched = append(matched, v)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return semver.Compare(normalizeVersion(matched[i]), normalizeVersion(matched[j])) < 0
+	})
+
+	if sel.LatestMinors > 0 {
+		latest := []string{}
+		for i := len(matched) - 1; i >= 0 && len(latest) < sel.LatestMinors; i-- {
+			v := matched[i]
+			if len(latest) > 0 && semver.MajorMinor(normalizeVersion(latest[0])) == semver.MajorMinor(normalizeVersion(v)) {
+				continue
+			}
+			latest = append([]string{v}, latest...)
+		}
+		matched = latest
+	}
+	if sel.Limit > 0 && len(matched) > sel.Limit {
+		matched = matched[len(matched)-sel.Limit:]
+	}
+
+	if len(matched) == 0 {
+		return nil, &NoMatchingVersionError{Selector: sel, Candidates: len(versions)}
+	}
+	return matched, nil
+}
+
+// ResolveLatestVersion returns the highest version matching the selector.
+func ResolveLatestVersion(versions []string, sel VersionSelector) (string, error) {
+	matched, err := ResolveVersions(versions, sel)
+	if err != nil {
+		return "", err
+	}
+	return matched[len(matched)-1], nil
+}
+
+// ResolveGitTags is ResolveVersions over the semver of the tags, see TagQuery.
+func ResolveGitTags(tags []GitTag, sel VersionSelector) ([]GitTag, error) {
+	byVersion := map[string]GitTag{}
+	versions := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t.Version == "" {
+			continue
+		}
+		if _, ok := byVersion[t.Version]; !ok {
+			versions = append(versions, t.Version)
+		}
+		byVersion[t.Version] = t
+	}
+
+	matched, err := ResolveVersions(versions, sel)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]GitTag, 0, len(matched))
+	for _, v := range matched {
+		resolved = append(resolved, byVersion[v])
+	}
+	return resolved, nil
+}
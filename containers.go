@@ -2,8 +2,10 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"dagger.io/dagger"
 	"golang.org/x/sync/errgroup"
@@ -11,7 +13,6 @@ import (
 
 func BuildK8SUtils(c *dagger.Client, ctx context.Context) (err error) {
 	baseContainer := c.Container().From("docker.io/alpine:3.17.3")
-	gitContainer := c.Container().From("docker.io/alpine/git:2.36.3").WithEntrypoint([]string{})
 
 	openshiftTags := []string{}
 	k8sTags := []string{}
@@ -24,18 +25,31 @@ func BuildK8SUtils(c *dagger.Client, ctx context.Context) (err error) {
 	gitK8SRepo := "https://github.com/kubernetes/kubernetes.git"
 	gitHelmRepo := "https://github.com/helm/helm.git"
 
+	// a nil cache looks the tags up every time
+	tagCache, err := NewTagCacheFromEnv(6 * time.Hour)
+	if err != nil {
+		log.Printf("WARNING: tag cache disabled: %s", err)
+		tagCache = nil
+	}
+
 	eg, gctx := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
-		openshiftTags, err = GetGitTags(gitOCPRepo, "master", gitContainer, c, gctx)
+		tags, err := tagCache.GetRemoteGitTags(gctx, gitOCPRepo)
+		openshiftTags = tags
 		return err
 	})
 	eg.Go(func() error {
-		k8sTags, err = GetGitTags(gitK8SRepo, "master", gitContainer, c, gctx)
+		tags, err := tagCache.GetRemoteGitTags(gctx, gitK8SRepo)
+		k8sTags = tags
 		return err
 	})
 	eg.Go(func() error {
-		vHelm, err = GetLatestGitTag(gitHelmRepo, "main", gitContainer, c, gctx)
+		helmTags, err := tagCache.GetRemoteGitTags(gctx, gitHelmRepo)
+		if err != nil {
+			return err
+		}
+		vHelm, err = ResolveLatestVersion(helmTags, VersionSelector{})
 		return err
 	})
 
@@ -63,14 +77,34 @@ func BuildK8SUtils(c *dagger.Client, ctx context.Context) (err error) {
 		})
 
 	log.Println("Matching OpenShift/Kubernetes upstream tags:", sameTags)
-	for _, tag := range sameTags[len(sameTags)-5:] {
-		_, err = buildK8SUtil(tag, vKustomize, vHelm, baseContainer, c, ctx)
-		if err != nil {
-			return err
+	k8sVersions, err := ResolveVersions(sameTags, VersionSelector{LatestMinors: 5})
+	if err != nil {
+		return
+	}
+
+	rows := [][]string{}
+	buildErrs := []error{}
+	for _, tag := range k8sVersions {
+		// containers are lazy, only a sync tells whether the build worked
+		container, buildErr := buildK8SUtil(tag, vKustomize, vHelm, baseContainer, c, ctx)
+		if buildErr == nil {
+			_, buildErr = container.Sync(ctx)
+		}
+		status := StatusSuccess
+		if buildErr != nil {
+			status = StatusFailure
+			buildErrs = append(buildErrs, fmt.Errorf("ERROR: could not build k8s-utils %s: %s", tag, buildErr))
 		}
+		rows = append(rows, []string{tag, vKustomize, vHelm, status.Emoji()})
 	}
 
-	return
+	report := NewReport("Kubernetes Utilities").
+		Table([]string{"Kubernetes", "Kustomize", "Helm", "Status"}, rows)
+	if err = WriteGitHubStepSummary(report); err != nil {
+		return
+	}
+
+	return errors.Join(buildErrs...)
 }
 
 func buildK8SUtil(vK8S, vKustomize, vHelm string, baseContainer *dagger.Container, c *dagger.Client, ctx context.Context) (container *dagger.Container, err error) {
@@ -86,6 +120,6 @@ func buildK8SUtil(vK8S, vKustomize, vHelm string, baseContainer *dagger.Containe
 	}
 
 	baseContainer = baseContainer.WithEntrypoint([]string{})
-	container, err = WithBinaries(containerBuilds, baseContainer, c)
+	container, err = WithBinariesAndSBOM("k8s-utils", vK8S, containerBuilds, SBOMFormatSPDX, "/usr/share/sbom/k8s-utils.spdx.json", baseContainer, c)
 	return
 }
@@ -0,0 +1,245 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v56/github"
+)
+
+var (
+	ErrWorkflowRunNotFound = errors.New("ERROR: could not find the dispatched workflow run.")
+)
+
+// CorrelationIDInput is the input/client_payload key used to find a dispatched run again.
+// The target workflow has to echo it in its run name, e.g.:
+//
+//	run-name: "Deploy [${{ inputs.correlation_id }}]"
+//	run-name: "Deploy [${{ github.event.client_payload.correlation_id }}]"
+const CorrelationIDInput = "correlation_id"
+
+type DispatchOpts struct {
+	// Initial delay between polls, doubled up to MaxPollInterval. Defaults to 5s.
+	PollInterval time.Duration
+	// Defaults to 1m.
+	MaxPollInterval time.Duration
+	// How long to look for the run created by the dispatch before giving up. Defaults to 2m.
+	FindTimeout time.Duration
+}
+
+func (o DispatchOpts) withDefaults() DispatchOpts {
+	if o.PollInterval == 0 {
+		o.PollInterval = 5 * time.Second
+	}
+	if o.MaxPollInterval == 0 {
+		o.MaxPollInterval = time.Minute
+	}
+	if o.FindTimeout == 0 {
+		o.FindTimeout = 2 * time.Minute
+	}
+	return o
+}
+
+type WorkflowJobResult struct {
+	Name       string
+	Conclusion string
+	HTMLURL    string
+}
+
+type WorkflowRunResult struct {
+	RunID      int64
+	Status     string
+	Conclusion string
+	HTMLURL    string
+	// API URL to download the run logs archive.
+	LogsURL string
+	Jobs    []WorkflowJobResult
+}
+
+func (r *WorkflowRunResult) Succeeded() bool {
+	return r.Conclusion == "success"
+}
+
+func NewCorrelationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// DispatchWorkflow triggers a workflow_dispatch event and returns the correlation ID added to its inputs.
+func (gha *GitHubActions) DispatchWorkflow(ctx context.Context, owner, repo, workflowFile, ref string, inputs map[string]interface{}) (correlationID string, err error) {
+	correlationID, err = NewCorrelationID()
+	if err != nil {
+		return
+	}
+
+	eventInputs := map[string]interface{}{CorrelationIDInput: correlationID}
+	for k, v := range inputs {
+		eventInputs[k] = v
+	}
+
+	_, err = gha.Client.Actions.CreateWorkflowDispatchEventByFileName(ctx, owner, repo, workflowFile, github.CreateWorkflowDispatchEventRequest{
+		Ref:    ref,
+		Inputs: eventInputs,
+	})
+	if err != nil {
+		err = fmt.Errorf("ERROR: could not dispatch workflow %s in %s/%s: %s", workflowFile, owner, repo, err)
+	}
+	return
+}
+
+// DispatchRepositoryEvent triggers a repository_dispatch event and returns the correlation ID added to its client_payload.
+func (gha *GitHubActions) DispatchRepositoryEvent(ctx context.Context, owner, repo, eventType string, payload map[string]interface{}) (correlationID string, err error) {
+	correlationID, err = NewCorrelationID()
+	if err != nil {
+		return
+	}
+
+	clientPayload := map[string]interface{}{CorrelationIDInput: correlationID}
+	for k, v := range payload {
+		clientPayload[k] = v
+	}
+	raw, err := json.Marshal(clientPayload)
+	if err != nil {
+		return
+	}
+	rawPayload := json.RawMessage(raw)
+
+	_, _, err = gha.Client.Repositories.Dispatch(ctx, owner, repo, github.DispatchRequestOptions{
+		EventType:     eventType,
+		ClientPayload: &rawPayload,
+	})
+	if err != nil {
+		err = fmt.Errorf("ERROR: could not dispatch %s event to %s/%s: %s", eventType, owner, repo, err)
+	}
+	return
+}
+
+// FindWorkflowRun looks for a run whose name contains the correlation ID. Pass an empty workflowFile to search
+// all workflows, e.g. for repository_dispatch events.
+func (gha *GitHubActions) FindWorkflowRun(ctx context.Context, owner, repo, workflowFile, event, correlationID string, since time.Time, opts DispatchOpts) (runID int64, err error) {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.FindTimeout)
+	defer cancel()
+
+	listOpts := &github.ListWorkflowRunsOptions{
+		Event: event,
+		// allow for some clock skew between us and GitHub
+		Created:     ">=" + since.Add(-time.Minute).UTC().Format(time.RFC3339),
+		ListOptions: github.ListOptions{PerPage: 50},
+	}
+
+	err = PollWithBackoff(ctx, opts.PollInterval, opts.MaxPollInterval, func() (bool, error) {
+		var runs *github.WorkflowRuns
+		var err error
+		if workflowFile == "" {
+			runs, _, err = gha.Client.Actions.ListRepositoryWorkflowRuns(ctx, owner, repo, listOpts)
+		} else {
+			runs, _, err = gha.Client.Actions.ListWorkflowRunsByFileName(ctx, owner, repo, workflowFile, listOpts)
+		}
+		if err != nil {
+			return false, err
+		}
+
+		for _, run := range runs.WorkflowRuns {
+			if strings.Contains(run.GetDisplayTitle(), correlationID) || strings.Contains(run.GetName(), correlationID) {
+				runID = run.GetID()
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) && runID == 0 {
+		err = ErrWorkflowRunNotFound
+	}
+	return
+}
+
+// WaitForWorkflowRun blocks until the run completes or ctx is cancelled.
+func (gha *GitHubActions) WaitForWorkflowRun(ctx context.Context, owner, repo string, runID int64, opts DispatchOpts) (*WorkflowRunResult, error) {
+	opts = opts.withDefaults()
+
+	var run *github.WorkflowRun
+	err := PollWithBackoff(ctx, opts.PollInterval, opts.MaxPollInterval, func() (bool, error) {
+		var err error
+		run, _, err = gha.Client.Actions.GetWorkflowRunByID(ctx, owner, repo, runID)
+		if err != nil {
+			return false, err
+		}
+		return run.GetStatus() == "completed", nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: waiting for workflow run %d: %w", runID, err)
+	}
+
+	result := &WorkflowRunResult{
+		RunID:      runID,
+		Status:     run.GetStatus(),
+		Conclusion: run.GetConclusion(),
+		HTMLURL:    run.GetHTMLURL(),
+		LogsURL:    run.GetLogsURL(),
+	}
+
+	jobOpts := &github.ListWorkflowJobsOptions{Filter: "latest", ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		jobs, resp, err := gha.Client.Actions.ListWorkflowJobs(ctx, owner, repo, runID, jobOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range jobs.Jobs {
+			result.Jobs = append(result.Jobs, WorkflowJobResult{
+				Name:       job.GetName(),
+				Conclusion: job.GetConclusion(),
+				HTMLURL:    job.GetHTMLURL(),
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		jobOpts.Page = resp.NextPage
+	}
+
+	return result, nil
+}
+
+// DispatchWorkflowAndWait triggers workflowFile on ref and blocks until the resulting run completes.
+func (gha *GitHubActions) DispatchWorkflowAndWait(ctx context.Context, owner, repo, workflowFile, ref string, inputs map[string]interface{}, opts DispatchOpts) (*WorkflowRunResult, error) {
+	since := time.Now()
+	correlationID, err := gha.DispatchWorkflow(ctx, owner, repo, workflowFile, ref, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	runID, err := gha.FindWorkflowRun(ctx, owner, repo, workflowFile, "workflow_dispatch", correlationID, since, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return gha.WaitForWorkflowRun(ctx, owner, repo, runID, opts)
+}
+
+// DispatchRepositoryEventAndWait triggers a repository_dispatch event and blocks until the resulting run completes.
+func (gha *GitHubActions) DispatchRepositoryEventAndWait(ctx context.Context, owner, repo, eventType string, payload map[string]interface{}, opts DispatchOpts) (*WorkflowRunResult, error) {
+	since := time.Now()
+	correlationID, err := gha.DispatchRepositoryEvent(ctx, owner, repo, eventType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	runID, err := gha.FindWorkflowRun(ctx, owner, repo, "", "repository_dispatch", correlationID, since, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return gha.WaitForWorkflowRun(ctx, owner, repo, runID, opts)
+}
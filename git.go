@@ -3,35 +3,179 @@ package pipeline
 import (
 	"context"
 	"fmt"
-	"log"
+	"regexp"
+	"sort"
 	"strings"
 
 	"dagger.io/dagger"
 	"golang.org/x/mod/semver"
 )
 
-func GetGitTags(repoURL, ref string, container *dagger.Container, c *dagger.Client, ctx context.Context) (tags []string, err error) {
-	project := c.Git(repoURL, dagger.GitOpts{KeepGitDir: true}).Branch(ref).Tree()
+type TagSort string
+
+const (
+	// Ascending semver order, the default. Tags that aren't semver come first.
+	TagSortSemver     TagSort = "semver"
+	TagSortSemverDesc TagSort = "-semver"
+	TagSortRefname    TagSort = "refname"
+	// Order of the tagger/committer date, see `git for-each-ref --sort`.
+	TagSortCreatorDate     TagSort = "creatordate"
+	TagSortCreatorDateDesc TagSort = "-creatordate"
+)
+
+type TagQuery struct {
+	// Only tags starting with Prefix, e.g. "v" or "kustomize/v"
+	Prefix string
+	// Only tags whose full name matches Regex, when set
+	Regex string
+	// Keep semver prereleases like v1.2.0-rc.1
+	IncludePrerelease bool
+	// Remove Prefix from GitTag.Name
+	StripPrefix bool
+	// Drop tags that aren't valid semver, with or without the "v"
+	SemverOnly bool
+	Sort       TagSort
+	// Credentials for private repositories, not part of the tag cache key
+	Auth *GitAuth `json:"-"`
+}
+
+type GitTag struct {
+	// Full tag name, e.g. kustomize/v5.0.1
+	Tag string
+	// Tag without the prefix if StripPrefix was set, Tag otherwise
+	Name string
+	// Canonical semver with a "v", e.g. v5.0.1; empty if the tag isn't semver.
+	Version string
+	// Commit the tag points to, peeled for annotated tags
+	Commit string
+}
+
+func (t GitTag) IsPrerelease() bool {
+	return semver.Prerelease(t.Version) != ""
+}
+
+// tagVersion parses the part of the tag after prefix, e.g. "1.2.3" or "v1.2.3".
+func tagVersion(tag, prefix string) string {
+	v := strings.TrimPrefix(tag, prefix)
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	if !semver.IsValid(v) {
+		return ""
+	}
+	return semver.Canonical(v)
+}
+
+// FilterGitTags applies the query to tags listed without a prefix filter.
+func FilterGitTags(tags []GitTag, query TagQuery) ([]GitTag, error) {
+	var re *regexp.Regexp
+	if query.Regex != "" {
+		var err error
+		if re, err = regexp.Compile(query.Regex); err != nil {
+			return nil, fmt.Errorf("ERROR: invalid tag regex: %s", err)
+		}
+	}
+
+	filtered := []GitTag{}
+	for _, t := range tags {
+		if !strings.HasPrefix(t.Tag, query.Prefix) {
+			continue
+		}
+		if re != nil && !re.MatchString(t.Tag) {
+			continue
+		}
+		t.Version = tagVersion(t.Tag, query.Prefix)
+		if query.SemverOnly && t.Version == "" {
+			continue
+		}
+		if !query.IncludePrerelease && t.IsPrerelease() {
+			continue
+		}
+		t.Name = t.Tag
+		if query.StripPrefix {
+			t.Name = strings.TrimPrefix(t.Tag, query.Prefix)
+		}
+		filtered = append(filtered, t)
+	}
+
+	switch query.Sort {
+	case "", TagSortSemver:
+		sort.SliceStable(filtered, func(i, j int) bool { return compareTags(filtered[i], filtered[j]) < 0 })
+	case TagSortSemverDesc:
+		sort.SliceStable(filtered, func(i, j int) bool { return compareTags(filtered[i], filtered[j]) > 0 })
+	case TagSortRefname:
+		sort.SliceStable(filtered, func(i, j int) bool { return filtered[i].Tag < filtered[j].Tag })
+	}
+	return filtered, nil
+}
+
+func compareTags(a, b GitTag) int {
+	if cmp := semver.Compare(a.Version, b.Version); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(a.Tag, b.Tag)
+}
+
+// GetGitTagsWithQuery clones repoURL at ref and returns its tags matching the query.
+func GetGitTagsWithQuery(repoURL, ref string, query TagQuery, container *dagger.Container, c *dagger.Client, ctx context.Context) (tags []GitTag, err error) {
+	if err = query.Auth.Validate(); err != nil {
+		return
+	}
+	project, err := GitTree(repoURL, ref, true, query.Auth, container, c)
+	if err != nil {
+		return
+	}
+
+	gitSort := "refname"
+	if query.Sort == TagSortCreatorDate || query.Sort == TagSortCreatorDateDesc {
+		gitSort = string(query.Sort)
+	}
 
-	output, err := container.
+	output, err := query.Auth.WithGitAuth(repoURL, container).
 		WithMountedDirectory("/REPO", project).
 		WithWorkdir("/REPO").
 		WithExec([]string{"git", "fetch", "--tags"}).
-		WithExec([]string{"git", "tag", "-l", "v*", "--sort", "v:refname"}).
+		WithExec([]string{
+			"git", "for-each-ref",
+			"--sort", gitSort,
+			"--format", "%(refname:strip=2)%09%(objectname)%09%(*objectname)",
+			// a glob doesn't match across "/", so nested tags like "a/v1.0.0" are filtered by prefix afterwards
+			"refs/tags/",
+		}).
 		Stdout(ctx)
 	if err != nil {
 		err = fmt.Errorf("ERROR: could not get repository: %s; reason: %s", repoURL, err)
 		return
 	}
 
-	for _, tag := range strings.Split(output, "\n") {
-		tag = strings.TrimSpace(tag)
-		if !strings.Contains(tag, "-") && tag != "" {
-			tags = append(tags, strings.TrimSpace(tag))
+	return FilterGitTags(parseForEachRef(output), query)
+}
+
+func parseForEachRef(output string) (tags []GitTag) {
+	for _, line := range splitLines(output) {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
 		}
+		t := GitTag{Tag: fields[0], Commit: fields[1]}
+		if len(fields) > 2 && fields[2] != "" {
+			// annotated tag
+			t.Commit = fields[2]
+		}
+		tags = append(tags, t)
 	}
-	semver.Sort(tags)
+	return
+}
 
+// GetGitTags returns the stable "v" semver tags of repoURL in ascending order.
+func GetGitTags(repoURL, ref string, container *dagger.Container, c *dagger.Client, ctx context.Context) (tags []string, err error) {
+	gitTags, err := GetGitTagsWithQuery(repoURL, ref, TagQuery{Prefix: "v", SemverOnly: true}, container, c, ctx)
+	if err != nil {
+		return
+	}
+	for _, t := range gitTags {
+		tags = append(tags, t.Name)
+	}
 	return
 }
 
@@ -40,7 +184,5 @@ func GetLatestGitTag(repoURL, ref string, container *dagger.Container, c *dagger
 	if err != nil {
 		return
 	}
-	log.Println(tags)
-	tag = tags[len(tags)-1]
-	return
+	return ResolveLatestVersion(tags, VersionSelector{})
 }
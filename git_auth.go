@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	gitKnownHostsPath = "/etc/go-pipeline/known_hosts"
+	gitSSHAuthSock    = "/tmp/go-pipeline-ssh-agent.sock"
+	// the helper only answers `get`, so git never stores the token
+	gitCredentialHelper = `!f() { test "$1" = get && echo "username=${GIT_AUTH_USERNAME}" && echo "password=${GIT_AUTH_TOKEN}"; }; f`
+)
+
+var (
+	ErrMissingKnownHosts = errors.New("ERROR: SSH access needs known hosts to pin the host keys.")
+	ErrInvalidGitRef     = errors.New("ERROR: invalid git ref.")
+)
+
+// GitAuth authenticates git operations against private repositories. A nil *GitAuth means anonymous access.
+type GitAuth struct {
+	// HTTPS token, e.g. a GitHub PAT or GitLab job token
+	Token *dagger.Secret
+	// Username sent with the token, defaults to "x-access-token". GitLab job tokens need "gitlab-ci-token".
+	Username string
+	// Forwarded SSH agent for ssh:// and git@ URLs, e.g. c.Host().UnixSocket(os.Getenv("SSH_AUTH_SOCK"))
+	SSHAuthSocket *dagger.Socket
+	// known_hosts lines to pin the SSH host keys, required with SSHAuthSocket
+	KnownHosts string
+	// Accept unknown SSH host keys on first use when KnownHosts is empty. This doesn't protect against
+	// a spoofed host, only use it for throwaway environments.
+	InsecureAcceptNewHostKeys bool
+}
+
+func (a *GitAuth) username() string {
+	if a.Username == "" {
+		return "x-access-token"
+	}
+	return a.Username
+}
+
+// Validate checks that KnownHosts parses, and is set for SSH access unless InsecureAcceptNewHostKeys is.
+func (a *GitAuth) Validate() error {
+	if a == nil {
+		return nil
+	}
+	if a.KnownHosts == "" {
+		if a.SSHAuthSocket != nil && !a.InsecureAcceptNewHostKeys {
+			return ErrMissingKnownHosts
+		}
+		return nil
+	}
+	rest := []byte(a.KnownHosts)
+	for len(strings.TrimSpace(string(rest))) > 0 {
+		var err error
+		_, _, _, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			return fmt.Errorf("ERROR: invalid known hosts: %s", err)
+		}
+	}
+	return nil
+}
+
+// credentialOrigin returns the scheme and host of an HTTP(S) repository URL, e.g. "https://github.com".
+func credentialOrigin(repoURL string) (string, bool) {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// WithGitAuth configures the git of the container to use the credentials for repoURL, e.g. for `git fetch`.
+// The token is only given to the host of repoURL, not to submodules or redirects on other hosts.
+func (a *GitAuth) WithGitAuth(repoURL string, container *dagger.Container) *dagger.Container {
+	if a == nil {
+		return container
+	}
+
+	if a.Token != nil {
+		origin, ok := credentialOrigin(repoURL)
+		if !ok {
+			log.Printf("WARNING: the git token is only used for HTTP(S) URLs, not for %s", repoURL)
+		} else {
+			container = container.
+				WithEnvVariable("GIT_AUTH_USERNAME", a.username()).
+				WithSecretVariable("GIT_AUTH_TOKEN", a.Token).
+				WithEnvVariable("GIT_CONFIG_COUNT", "1").
+				WithEnvVariable("GIT_CONFIG_KEY_0", "credential."+origin+".helper").
+				WithEnvVariable("GIT_CONFIG_VALUE_0", gitCredentialHelper).
+				WithEnvVariable("GIT_TERMINAL_PROMPT", "0")
+		}
+	}
+
+	if a.SSHAuthSocket != nil {
+		container = container.
+			WithUnixSocket(gitSSHAuthSock, a.SSHAuthSocket).
+			WithEnvVariable("SSH_AUTH_SOCK", gitSSHAuthSock)
+	}
+	if a.KnownHosts != "" {
+		container = container.
+			WithNewFile(gitKnownHostsPath, dagger.ContainerWithNewFileOpts{Contents: a.KnownHosts, Permissions: 0644}).
+			WithEnvVariable("GIT_SSH_COMMAND", "ssh -o UserKnownHostsFile="+gitKnownHostsPath+" -o StrictHostKeyChecking=yes")
+	} else if a.SSHAuthSocket != nil && a.InsecureAcceptNewHostKeys {
+		container = container.WithEnvVariable("GIT_SSH_COMMAND", "ssh -o StrictHostKeyChecking=accept-new")
+	} else if a.SSHAuthSocket != nil {
+		container = container.WithEnvVariable("GIT_SSH_COMMAND", "ssh -o StrictHostKeyChecking=yes")
+	}
+	return container
+}
+
+// validateGitRef rejects refs git would parse as an option.
+func validateGitRef(ref string) error {
+	if strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("%w: %s", ErrInvalidGitRef, ref)
+	}
+	return nil
+}
+
+// GitTree returns the tree of repoURL at ref (a branch or tag). Without a token it uses c.Git, which supports SSH auth.
+// With a token the repository is cloned in the container, which needs git, since c.Git can't use it.
+// Call auth.Validate first.
+func GitTree(repoURL, ref string, keepGitDir bool, auth *GitAuth, container *dagger.Container, c *dagger.Client) (*dagger.Directory, error) {
+	if err := validateGitRef(ref); err != nil {
+		return nil, err
+	}
+	if auth == nil || auth.Token == nil {
+		opts := dagger.GitRefTreeOpts{}
+		if auth != nil {
+			opts.SSHAuthSocket = auth.SSHAuthSocket
+			opts.SSHKnownHosts = auth.KnownHosts
+		}
+		return c.Git(repoURL, dagger.GitOpts{KeepGitDir: keepGitDir}).Branch(ref).Tree(opts), nil
+	}
+
+	clone := auth.WithGitAuth(repoURL, container.WithEntrypoint([]string{})).
+		// the branch may have moved since the last run, never reuse a cached clone
+		WithEnvVariable("CACHE_BUSTER", strconv.FormatInt(time.Now().UnixNano(), 10)).
+		WithExec([]string{"git", "clone", "--branch", ref, "--", repoURL, "/CLONE"})
+	if !keepGitDir {
+		clone = clone.WithExec([]string{"rm", "-rf", "/CLONE/.git"})
+	}
+	return clone.Directory("/CLONE"), nil
+}
+
+// basicAuthTransport adds the token as basic auth to the requests of ListRemoteRefs to origin,
+// so it isn't sent to another host, or over plain HTTP, after a redirect.
+type basicAuthTransport struct {
+	origin   string
+	username string
+	password string
+	base     http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme+"://"+req.URL.Host != t.origin {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.base.RoundTrip(req)
+}
+
+// HTTPClient returns a client sending the token to the git smart-HTTP server of repoURL,
+// or http.DefaultClient without a token.
+func (a *GitAuth) HTTPClient(ctx context.Context, repoURL string) (*http.Client, error) {
+	if a == nil || a.Token == nil {
+		return http.DefaultClient, nil
+	}
+	origin, ok := credentialOrigin(repoURL)
+	if !ok {
+		return nil, fmt.Errorf("ERROR: the git token is only used for HTTP(S) URLs, not for %s", repoURL)
+	}
+	token, err := a.Token.Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &basicAuthTransport{origin: origin, username: a.username(), password: token, base: http.DefaultTransport}}, nil
+}
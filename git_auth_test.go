@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthTransportScope(t *testing.T) {
+	var leaked bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, leaked = r.BasicAuth()
+	}))
+	t.Cleanup(other.Close)
+	var authenticated bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, authenticated = r.BasicAuth()
+		http.Redirect(w, r, other.URL+"/repo.git", http.StatusFound)
+	}))
+	t.Cleanup(origin.Close)
+
+	originURL, _ := credentialOrigin(origin.URL + "/repo.git")
+	client := &http.Client{Transport: &basicAuthTransport{origin: originURL, username: "x-access-token", password: "secret", base: http.DefaultTransport}}
+	resp, err := client.Get(origin.URL + "/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !authenticated {
+		t.Errorf("expected the token to be sent to the origin")
+	}
+	if leaked {
+		t.Errorf("the token was sent to another host after a redirect")
+	}
+}
+
+func TestGitCredentialHelperScope(t *testing.T) {
+	requireCommands(t, "git")
+	origin, ok := credentialOrigin("https://git.example.com/group/repo.git")
+	if !ok || origin != "https://git.example.com" {
+		t.Fatalf("unexpected origin %q", origin)
+	}
+	if _, ok = credentialOrigin("git@git.example.com:group/repo.git"); ok {
+		t.Errorf("expected no origin for an SSH URL")
+	}
+
+	env := map[string]string{
+		"GIT_AUTH_USERNAME":   "x-access-token",
+		"GIT_AUTH_TOKEN":      "secret",
+		"GIT_CONFIG_COUNT":    "1",
+		"GIT_CONFIG_KEY_0":    "credential." + origin + ".helper",
+		"GIT_CONFIG_VALUE_0":  gitCredentialHelper,
+		"GIT_TERMINAL_PROMPT": "0",
+		"GIT_ASKPASS":         "",
+	}
+	fill := func(host string) string {
+		cmd := "printf 'protocol=https\\nhost=" + host + "\\npath=group/repo.git\\n\\n' | git credential fill"
+		out, _ := runInDir(t, t.TempDir(), env, "sh", "-c", cmd)
+		return out
+	}
+
+	if out := fill("git.example.com"); !containsLine(out, "password=secret") {
+		t.Errorf("expected the token for the origin host, got: %s", out)
+	}
+	if out := fill("submodule.example.com"); containsLine(out, "password=secret") {
+		t.Errorf("the token was given to another host: %s", out)
+	}
+}
+
+func containsLine(s, line string) bool {
+	for _, l := range splitLines(s) {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+var (
+	describeRegex = regexp.MustCompile(`^(.+)-(\d+)-g([0-9a-f]+)$`)
+	imageTagRegex = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// GitInfo describes the commit being built.
+type GitInfo struct {
+	SHA      string
+	ShortSHA string
+	// Empty for a detached HEAD without a CI branch
+	Branch string
+	// `git describe --tags --long --always --dirty` output, empty when it comes from CI env vars.
+	Describe string
+	// Nearest tag, and the number of commits since
+	Tag             string
+	CommitsSinceTag int
+	Dirty           bool
+	CommitTime      time.Time
+	AuthorName      string
+	AuthorEmail     string
+}
+
+// Version is the `git describe` style version, e.g. v1.2.3, v1.2.3-4-gabc1234 or v1.2.3-4-gabc1234-dirty.
+// Without a tag it is v0.0.0-gabc1234.
+func (g *GitInfo) Version() string {
+	var v string
+	switch {
+	case g.Tag == "":
+		v = "v0.0.0-g" + g.ShortSHA
+	case g.CommitsSinceTag == 0:
+		v = g.Tag
+	default:
+		v = fmt.Sprintf("%s-%d-g%s", g.Tag, g.CommitsSinceTag, g.ShortSHA)
+	}
+	if g.Dirty {
+		v += "-dirty"
+	}
+	return v
+}
+
+// ImageTag is Version with the characters OCI tags don't allow replaced, e.g. "kustomize/v5.0.1" -> "kustomize-v5.0.1".
+func (g *GitInfo) ImageTag() string {
+	tag := imageTagRegex.ReplaceAllString(g.Version(), "-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+// LDFlags sets the version, commit and date variables of pkg, e.g. "main", for `go build -ldflags`.
+func (g *GitInfo) LDFlags(pkg string) string {
+	date := g.CommitTime.UTC().Format(time.RFC3339)
+	return fmt.Sprintf("-X %s.version=%s -X %s.commit=%s -X %s.date=%s", pkg, g.Version(), pkg, g.SHA, pkg, date)
+}
+
+// readGitInfo collects the info with run, which executes a git command in the repository.
+func readGitInfo(run func(args ...string) (string, error)) (*GitInfo, error) {
+	out, err := run("git", "log", "-1", "--format=%H%n%h%n%ct%n%an%n%ae")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("ERROR: unexpected git log output: '%s'", out)
+	}
+	info := &GitInfo{SHA: fields[0], ShortSHA: fields[1], AuthorName: fields[3], AuthorEmail: fields[4]}
+	if ts, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+		info.CommitTime = time.Unix(ts, 0).UTC()
+	}
+
+	if out, err = run("git", "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return nil, err
+	}
+	if branch := strings.TrimSpace(out); branch != "HEAD" {
+		info.Branch = branch
+	}
+
+	if out, err = run("git", "status", "--porcelain", "--untracked-files=no"); err != nil {
+		return nil, err
+	}
+	info.Dirty = strings.TrimSpace(out) != ""
+
+	if out, err = run("git", "describe", "--tags", "--long", "--always", "--dirty"); err != nil {
+		return nil, err
+	}
+	info.Describe = strings.TrimSpace(out)
+	if m := describeRegex.FindStringSubmatch(strings.TrimSuffix(info.Describe, "-dirty")); m != nil {
+		info.Tag = m[1]
+		info.CommitsSinceTag, _ = strconv.Atoi(m[2])
+	}
+	return info, nil
+}
+
+// gitInfoFromCI fills what the CI provider knows, for checkouts without a .git directory.
+func gitInfoFromCI(ctx context.Context) (*GitInfo, error) {
+	provider := DetectCIProvider(ctx)
+	sha := provider.CommitSHA()
+	if sha == "" {
+		return nil, fmt.Errorf("ERROR: no git repository, and no commit in the %s CI environment", provider.Name())
+	}
+
+	info := &GitInfo{SHA: sha, ShortSHA: sha, Branch: provider.Branch()}
+	if len(sha) > 7 {
+		info.ShortSHA = sha[:7]
+	}
+	return info, nil
+}
+
+// fillFromCI completes the branch of a detached HEAD, which is the usual CI checkout.
+func (g *GitInfo) fillFromCI(ctx context.Context) {
+	if g.Branch == "" {
+		g.Branch = DetectCIProvider(ctx).Branch()
+	}
+}
+
+// GetGitInfo reads the repository at path on the host, falling back to the CI env vars when git or the repository is missing.
+func GetGitInfo(ctx context.Context, path string) (*GitInfo, error) {
+	info, err := readGitInfo(func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Dir = path
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("ERROR: '%s' failed; reason: %s", strings.Join(args, " "), err)
+		}
+		return string(out), nil
+	})
+	if err != nil {
+		if ciInfo, ciErr := gitInfoFromCI(ctx); ciErr == nil {
+			return ciInfo, nil
+		}
+		return nil, err
+	}
+	info.fillFromCI(ctx)
+	return info, nil
+}
+
+// GetGitInfoFromDirectory reads a repository directory that includes .git, the container needs git.
+func GetGitInfoFromDirectory(repoDir *dagger.Directory, container *dagger.Container, c *dagger.Client, ctx context.Context) (*GitInfo, error) {
+	container = container.WithEntrypoint([]string{})
+	info, err := readGitInfo(func(args ...string) (string, error) {
+		return gitOutput(repoDir, container, ctx, args...)
+	})
+	if err != nil {
+		if ciInfo, ciErr := gitInfoFromCI(ctx); ciErr == nil {
+			return ciInfo, nil
+		}
+		return nil, err
+	}
+	info.fillFromCI(ctx)
+	return info, nil
+}
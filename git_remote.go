@@ -0,0 +1,257 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Git smart-HTTP client, enough for `git ls-remote`.
+// See: https://git-scm.com/docs/protocol-v2 and https://git-scm.com/docs/http-protocol
+
+var (
+	ErrInvalidPktLine = errors.New("ERROR: invalid git pkt-line.")
+	ErrGitServer      = errors.New("ERROR: git server returned an error.")
+)
+
+const (
+	pktFlush = "0000"
+	pktDelim = "0001"
+)
+
+type RemoteRef struct {
+	// Full ref name, e.g. refs/tags/v1.28.2
+	Name string
+	// Object the ref points to, a tag object for annotated tags
+	Object string
+	// Commit the ref points to, peeled for annotated tags
+	Commit string
+}
+
+// pktLine encodes one data line of the git wire protocol.
+func pktLine(data string) string {
+	return fmt.Sprintf("%04x%s", len(data)+4, data)
+}
+
+// pktReader reads git pkt-lines. Flush, delim and response-end packets are returned as nil with their code,
+// and "ERR" packets as ErrGitServer.
+type pktReader struct {
+	r *bufio.Reader
+}
+
+func (p *pktReader) next() (data []byte, special string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(p.r, header); err != nil {
+		return
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w header: '%s'", ErrInvalidPktLine, header)
+	}
+	if length < 4 {
+		return nil, string(header), nil
+	}
+
+	data = make([]byte, length-4)
+	if _, err = io.ReadFull(p.r, data); err != nil {
+		return nil, "", fmt.Errorf("%w %s", ErrInvalidPktLine, err)
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if msg, ok := bytes.CutPrefix(data, []byte("ERR ")); ok {
+		return nil, "", fmt.Errorf("%w %s", ErrGitServer, msg)
+	}
+	return data, "", nil
+}
+
+// ListRemoteRefs lists the refs of an HTTP(S) git remote starting with one of prefixes, without cloning it.
+// It uses protocol v2 `ls-refs` and falls back to the v0 ref advertisement for older servers.
+func ListRemoteRefs(ctx context.Context, client *http.Client, repoURL string, prefixes []string) ([]RemoteRef, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	repoURL = strings.TrimSuffix(repoURL, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, repoURL+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = checkGitResponse(resp); err != nil {
+		return nil, err
+	}
+
+	pkts := &pktReader{r: bufio.NewReader(resp.Body)}
+	line, special, err := pkts.next()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(line), "# service=") {
+		// smart-HTTP service announcement, followed by a flush
+		if _, special, err = pkts.next(); err != nil || special != pktFlush {
+			return nil, fmt.Errorf("%w expected flush after service announcement", ErrInvalidPktLine)
+		}
+		if line, special, err = pkts.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if special == "" && string(line) == "version 2" {
+		return lsRefs(ctx, client, repoURL, prefixes)
+	}
+	return parseRefAdvertisement(pkts, line, special, prefixes)
+}
+
+func checkGitResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &HTTPError{
+			Method:     resp.Request.Method,
+			URL:        resp.Request.URL.Redacted(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       string(body),
+		}
+	}
+	return nil
+}
+
+func lsRefs(ctx context.Context, client *http.Client, repoURL string, prefixes []string) ([]RemoteRef, error) {
+	var body strings.Builder
+	body.WriteString(pktLine("command=ls-refs\n"))
+	body.WriteString(pktLine("agent=go-pipeline\n"))
+	body.WriteString(pktDelim)
+	body.WriteString(pktLine("peel\n"))
+	for _, prefix := range prefixes {
+		body.WriteString(pktLine("ref-prefix " + prefix + "\n"))
+	}
+	body.WriteString(pktFlush)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, repoURL+"/git-upload-pack", strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = checkGitResponse(resp); err != nil {
+		return nil, err
+	}
+
+	refs := []RemoteRef{}
+	pkts := &pktReader{r: bufio.NewReader(resp.Body)}
+	for {
+		line, special, err := pkts.next()
+		if err != nil {
+			return nil, err
+		}
+		if special != "" {
+			return refs, nil
+		}
+
+		// <oid> <refname> [symref-target:<target>] [peeled:<oid>]
+		fields := strings.Split(string(line), " ")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%w ls-refs line: '%s'", ErrInvalidPktLine, line)
+		}
+		ref := RemoteRef{Name: fields[1], Object: fields[0], Commit: fields[0]}
+		for _, attr := range fields[2:] {
+			if peeled, ok := strings.CutPrefix(attr, "peeled:"); ok {
+				ref.Commit = peeled
+			}
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// parseRefAdvertisement reads the protocol v0 ref list, where annotated tags are followed by a "^{}" entry
+// holding the peeled commit.
+func parseRefAdvertisement(pkts *pktReader, line []byte, special string, prefixes []string) ([]RemoteRef, error) {
+	refs := []RemoteRef{}
+	index := map[string]int{}
+
+	for special == "" {
+		// the first line carries the capabilities after a NUL byte
+		entry, _, _ := strings.Cut(string(line), "\x00")
+		oid, name, ok := strings.Cut(entry, " ")
+		if !ok {
+			return nil, fmt.Errorf("%w ref advertisement line: '%s'", ErrInvalidPktLine, entry)
+		}
+
+		if base, peeled := strings.CutSuffix(name, "^{}"); peeled {
+			if i, ok := index[base]; ok {
+				refs[i].Commit = oid
+			}
+		} else if hasAnyPrefix(name, prefixes) && name != "capabilities^{}" {
+			index[name] = len(refs)
+			refs = append(refs, RemoteRef{Name: name, Object: oid, Commit: oid})
+		}
+
+		var err error
+		if line, special, err = pkts.next(); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListRemoteTags is the equivalent of GetGitTagsWithQuery using ListRemoteRefs, without a clone or container.
+func ListRemoteTags(ctx context.Context, repoURL string, query TagQuery) ([]GitTag, error) {
+	client, err := query.Auth.HTTPClient(ctx, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := ListRemoteRefs(ctx, client, repoURL, []string{"refs/tags/" + query.Prefix})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: could not list tags of repository: %s; reason: %s", repoURL, err)
+	}
+
+	tags := make([]GitTag, 0, len(refs))
+	for _, ref := range refs {
+		name, ok := strings.CutPrefix(ref.Name, "refs/tags/")
+		if !ok {
+			continue
+		}
+		tags = append(tags, GitTag{Tag: name, Commit: ref.Commit})
+	}
+	return FilterGitTags(tags, query)
+}
+
+// GetRemoteGitTags is GetGitTags using ListRemoteTags.
+func GetRemoteGitTags(ctx context.Context, repoURL string) (tags []string, err error) {
+	gitTags, err := ListRemoteTags(ctx, repoURL, TagQuery{Prefix: "v", SemverOnly: true})
+	if err != nil {
+		return
+	}
+	for _, t := range gitTags {
+		tags = append(tags, t.Name)
+	}
+	return
+}
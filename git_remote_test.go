@@ -0,0 +1,202 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	fakeMainCommit   = "1111111111111111111111111111111111111111"
+	fakeTagObject    = "2222222222222222222222222222222222222222"
+	fakeTagCommit    = "3333333333333333333333333333333333333333"
+	fakeLightCommit  = "4444444444444444444444444444444444444444"
+	fakeNestedCommit = "5555555555555555555555555555555555555555"
+)
+
+// fakeGitRef is a ref of the fake server, peeled is set for annotated tags.
+type fakeGitRef struct {
+	name, oid, peeled string
+}
+
+var fakeGitRefs = []fakeGitRef{
+	{name: "refs/heads/main", oid: fakeMainCommit},
+	{name: "refs/tags/v1.0.0", oid: fakeTagObject, peeled: fakeTagCommit},
+	{name: "refs/tags/v1.1.0", oid: fakeLightCommit},
+	{name: "refs/tags/sub/v0.1.0", oid: fakeNestedCommit},
+}
+
+// fakeGitServer answers the smart-HTTP requests of ListRemoteRefs, in protocol v2 unless v0 is set.
+type fakeGitServer struct {
+	v0       bool
+	username string
+	password string
+	// sent as an ERR packet in response to ls-refs
+	lsRefsErr string
+	// ref-prefix arguments of the last ls-refs request
+	prefixes []string
+}
+
+func (f *fakeGitServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.username != "" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != f.username || pass != f.password {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/repo.git/info/refs" && r.URL.Query().Get("service") == "git-upload-pack":
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		var body strings.Builder
+		body.WriteString(pktLine("# service=git-upload-pack\n"))
+		body.WriteString(pktFlush)
+		if !f.v0 && r.Header.Get("Git-Protocol") == "version=2" {
+			body.WriteString(pktLine("version 2\n"))
+			body.WriteString(pktLine("agent=fake\n"))
+			body.WriteString(pktLine("ls-refs=unborn\n"))
+			body.WriteString(pktFlush)
+		} else {
+			for i, ref := range fakeGitRefs {
+				line := ref.oid + " " + ref.name
+				if i == 0 {
+					line += "\x00multi_ack side-band-64k"
+				}
+				body.WriteString(pktLine(line + "\n"))
+				if ref.peeled != "" {
+					body.WriteString(pktLine(ref.peeled + " " + ref.name + "^{}\n"))
+				}
+			}
+			body.WriteString(pktFlush)
+		}
+		_, _ = w.Write([]byte(body.String()))
+
+	case r.Method == http.MethodPost && r.URL.Path == "/repo.git/git-upload-pack" && !f.v0:
+		pkts := &pktReader{r: bufio.NewReader(r.Body)}
+		peel := false
+		f.prefixes = nil
+		for {
+			line, special, err := pkts.next()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if special == pktFlush {
+				break
+			}
+			switch arg := string(line); {
+			case arg == "peel":
+				peel = true
+			case strings.HasPrefix(arg, "ref-prefix "):
+				f.prefixes = append(f.prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+			}
+		}
+
+		var body strings.Builder
+		if f.lsRefsErr != "" {
+			body.WriteString(pktLine("ERR " + f.lsRefsErr + "\n"))
+		} else {
+			for _, ref := range fakeGitRefs {
+				if !hasAnyPrefix(ref.name, f.prefixes) {
+					continue
+				}
+				line := ref.oid + " " + ref.name
+				if peel && ref.peeled != "" {
+					line += " peeled:" + ref.peeled
+				}
+				body.WriteString(pktLine(line + "\n"))
+			}
+			body.WriteString(pktFlush)
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		_, _ = w.Write([]byte(body.String()))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeGitServer(t *testing.T, fake *fakeGitServer) string {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return server.URL + "/repo.git"
+}
+
+func TestListRemoteRefs(t *testing.T) {
+	expected := []RemoteRef{
+		{Name: "refs/tags/v1.0.0", Object: fakeTagObject, Commit: fakeTagCommit},
+		{Name: "refs/tags/v1.1.0", Object: fakeLightCommit, Commit: fakeLightCommit},
+		{Name: "refs/tags/sub/v0.1.0", Object: fakeNestedCommit, Commit: fakeNestedCommit},
+	}
+
+	for _, v0 := range []bool{false, true} {
+		fake := &fakeGitServer{v0: v0}
+		repoURL := newFakeGitServer(t, fake)
+
+		refs, err := ListRemoteRefs(context.Background(), nil, repoURL+"/", []string{"refs/tags/"})
+		if err != nil {
+			t.Fatalf("v0=%t: %s", v0, err)
+		}
+		if !reflect.DeepEqual(refs, expected) {
+			t.Errorf("v0=%t: unexpected refs:\n%+v\nexpected:\n%+v", v0, refs, expected)
+		}
+		if !v0 && !reflect.DeepEqual(fake.prefixes, []string{"refs/tags/"}) {
+			t.Errorf("expected the prefixes to be sent with ls-refs, got %v", fake.prefixes)
+		}
+	}
+}
+
+func TestListRemoteTagsPeeled(t *testing.T) {
+	repoURL := newFakeGitServer(t, &fakeGitServer{})
+
+	tags, err := ListRemoteTags(context.Background(), repoURL, TagQuery{Prefix: "v", SemverOnly: true, Sort: TagSortSemverDesc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := map[string]string{}
+	for _, tag := range tags {
+		commits[tag.Tag] = tag.Commit
+	}
+	expected := map[string]string{"v1.0.0": fakeTagCommit, "v1.1.0": fakeLightCommit}
+	if !reflect.DeepEqual(commits, expected) {
+		t.Errorf("expected the commits of the tags, annotated ones peeled: %v, got %v", expected, commits)
+	}
+}
+
+func TestListRemoteRefsAuth(t *testing.T) {
+	repoURL := newFakeGitServer(t, &fakeGitServer{username: "x-access-token", password: "secret"})
+	ctx := context.Background()
+
+	_, err := ListRemoteRefs(ctx, nil, repoURL, []string{"refs/tags/"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 HTTPError without credentials, got %v", err)
+	}
+
+	origin, _ := credentialOrigin(repoURL)
+	client := &http.Client{Transport: &basicAuthTransport{origin: origin, username: "x-access-token", password: "secret", base: http.DefaultTransport}}
+	refs, err := ListRemoteRefs(ctx, client, repoURL, []string{"refs/tags/v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("expected 2 tags, got %+v", refs)
+	}
+}
+
+func TestListRemoteRefsServerError(t *testing.T) {
+	repoURL := newFakeGitServer(t, &fakeGitServer{lsRefsErr: "access denied"})
+
+	_, err := ListRemoteRefs(context.Background(), nil, repoURL, []string{"refs/tags/"})
+	if !errors.Is(err, ErrGitServer) {
+		t.Fatalf("expected ErrGitServer, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("expected the server message in the error, got %q", err)
+	}
+}
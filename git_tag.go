@@ -0,0 +1,260 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+var (
+	ErrInvalidTagSignature = errors.New("ERROR: tag signature verification failed.")
+)
+
+type TagSigningFormat string
+
+const (
+	TagSigningNone TagSigningFormat = ""
+	// Sign with an SSH private key, needs git >= 2.34 and ssh-keygen in the container.
+	TagSigningSSH TagSigningFormat = "ssh"
+	// Sign with an armored GPG secret key without passphrase, needs gpg in the container.
+	TagSigningGPG TagSigningFormat = "gpg"
+)
+
+const gitSigningKeySecretPath = "/run/secrets/go-pipeline-signing-key"
+
+type CreateTagOptions struct {
+	// Defaults to "Release <tag>"
+	Message string
+	// Commit to tag, defaults to HEAD
+	Ref string
+	// Default to go-pipeline
+	TaggerName  string
+	TaggerEmail string
+	// Replace an existing tag
+	Force         bool
+	SigningFormat TagSigningFormat
+	SigningKey    *dagger.Secret
+}
+
+// signingKeyScript returns the shell commands making the key at keyPath usable by git, and the git config to sign with it.
+func signingKeyScript(format TagSigningFormat, keyPath string) ([]string, []string, error) {
+	switch format {
+	case TagSigningNone:
+		return nil, nil, nil
+	case TagSigningSSH:
+		// ssh-keygen refuses keys readable by others
+		setup := []string{`SIGNING_KEY=$(mktemp)`, `install -m 600 "` + keyPath + `" "$SIGNING_KEY"`}
+		config := []string{"-c", "gpg.format=ssh", "-c", `user.signingkey="$SIGNING_KEY"`}
+		return setup, config, nil
+	case TagSigningGPG:
+		setup := []string{
+			`gpg --batch --import "` + keyPath + `"`,
+			`SIGNING_KEY=$(gpg --batch --with-colons --list-secret-keys | awk -F: '$1 == "fpr" { print $10; exit }')`,
+		}
+		config := []string{"-c", "gpg.format=openpgp", "-c", `user.signingkey="$SIGNING_KEY"`}
+		return setup, config, nil
+	default:
+		return nil, nil, fmt.Errorf("ERROR: unsupported tag signing format: '%s'", format)
+	}
+}
+
+// createTagScript returns the script creating the tag in the current directory, and the env vars it reads.
+// Names and message go through env vars, so they need no shell quoting.
+func createTagScript(tag string, opts CreateTagOptions, keyPath string) (string, map[string]string, error) {
+	if opts.Message == "" {
+		opts.Message = "Release " + tag
+	}
+	if opts.Ref == "" {
+		opts.Ref = "HEAD"
+	}
+	if opts.TaggerName == "" {
+		opts.TaggerName = "go-pipeline"
+	}
+	if opts.TaggerEmail == "" {
+		opts.TaggerEmail = "go-pipeline@localhost"
+	}
+
+	setup, signConfig, err := signingKeyScript(opts.SigningFormat, keyPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	args := []string{"git", "-c", `user.name="$TAGGER_NAME"`, "-c", `user.email="$TAGGER_EMAIL"`}
+	args = append(args, signConfig...)
+	args = append(args, "tag")
+	if opts.SigningFormat == TagSigningNone {
+		args = append(args, "-a")
+	} else {
+		args = append(args, "-s")
+	}
+	if opts.Force {
+		args = append(args, "-f")
+	}
+	args = append(args, "-m", `"$TAG_MESSAGE"`, `"$TAG_NAME"`, `"$TAG_REF"`)
+	script := strings.Join(append(append([]string{"set -e"}, setup...), strings.Join(args, " ")), "\n")
+
+	env := map[string]string{
+		"TAGGER_NAME":  opts.TaggerName,
+		"TAGGER_EMAIL": opts.TaggerEmail,
+		"TAG_MESSAGE":  opts.Message,
+		"TAG_NAME":     tag,
+		"TAG_REF":      opts.Ref,
+	}
+	return script, env, nil
+}
+
+// withEnvVariables sets env in a stable order, so the cache key doesn't change between runs.
+func withEnvVariables(container *dagger.Container, env map[string]string) *dagger.Container {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		container = container.WithEnvVariable(name, env[name])
+	}
+	return container
+}
+
+// CreateGitTag creates an annotated, optionally signed, tag in repoDir and returns the updated directory.
+// repoDir must contain the .git directory, and the container needs git.
+func CreateGitTag(repoDir *dagger.Directory, tag string, opts CreateTagOptions, container *dagger.Container, c *dagger.Client, ctx context.Context) (*dagger.Directory, error) {
+	script, env, err := createTagScript(tag, opts, gitSigningKeySecretPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SigningFormat != TagSigningNone && opts.SigningKey == nil {
+		return nil, fmt.Errorf("ERROR: tag signing format '%s' needs a signing key", opts.SigningFormat)
+	}
+
+	ctr := container.WithEntrypoint([]string{})
+	if opts.SigningKey != nil {
+		ctr = ctr.WithMountedSecret(gitSigningKeySecretPath, opts.SigningKey)
+	}
+	ctr, err = withEnvVariables(ctr.WithMountedDirectory("/REPO", repoDir).WithWorkdir("/REPO"), env).
+		WithExec([]string{"sh", "-c", script}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: could not create tag %s: %s", tag, err)
+	}
+	return ctr.Directory("/REPO"), nil
+}
+
+// PushGitTags pushes the tags of repoDir to remote, a URL or a configured remote name like "origin".
+func PushGitTags(repoDir *dagger.Directory, remote string, tags []string, auth *GitAuth, container *dagger.Container, c *dagger.Client, ctx context.Context) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	if err := auth.Validate(); err != nil {
+		return err
+	}
+
+	args := pushTagsArgs(remote, tags)
+
+	ctr := container.WithEntrypoint([]string{}).
+		WithMountedDirectory("/REPO", repoDir).
+		WithWorkdir("/REPO")
+	remoteURL := remote
+	if _, ok := credentialOrigin(remote); !ok && auth != nil && auth.Token != nil {
+		// the token is scoped to the host of the remote, a remote name needs its URL
+		out, err := ctr.WithExec([]string{"git", "remote", "get-url", "--", remote}).Stdout(ctx)
+		if err != nil {
+			return fmt.Errorf("ERROR: could not get the URL of remote %s: %s", remote, err)
+		}
+		remoteURL = strings.TrimSpace(out)
+	}
+
+	_, err := auth.WithGitAuth(remoteURL, ctr).
+		// a push is a side effect, it must run every time
+		WithEnvVariable("CACHE_BUSTER", strconv.FormatInt(time.Now().UnixNano(), 10)).
+		WithExec(args).
+		Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("ERROR: could not push tags %v: %s", tags, err)
+	}
+	return nil
+}
+
+func pushTagsArgs(remote string, tags []string) []string {
+	args := []string{"git", "push", remote}
+	for _, t := range tags {
+		args = append(args, "refs/tags/"+t)
+	}
+	return args
+}
+
+type VerifyTagOptions struct {
+	Format TagSigningFormat
+	// For SSH: allowed signers lines, "<email> <key type> <public key>", see ssh-keygen(1).
+	// For GPG: the armored public key.
+	TrustedKeys string
+}
+
+const verifyTagStatusPrefix = "go-pipeline-verify-status="
+
+// verifyTagScript returns the script verifying the tag named by $TAG_NAME against the keys at trustedKeysPath.
+// The script only fails for missing tools, tags or keys; the exit code of `git tag -v` is printed last,
+// see verifyTagResult.
+func verifyTagScript(format TagSigningFormat, trustedKeysPath string) (string, error) {
+	commands := []string{"set -e", "command -v git >/dev/null"}
+	config := ""
+	switch format {
+	case TagSigningSSH:
+		commands = append(commands, "command -v ssh-keygen >/dev/null")
+		config = `-c gpg.ssh.allowedSignersFile="` + trustedKeysPath + `" `
+	case TagSigningGPG:
+		commands = append(commands, "command -v gpg >/dev/null", `gpg --batch --import "`+trustedKeysPath+`" 2>/dev/null`)
+	default:
+		return "", fmt.Errorf("ERROR: unsupported tag signing format: '%s'", format)
+	}
+	commands = append(commands,
+		`git rev-parse -q --verify "refs/tags/$TAG_NAME" >/dev/null || { echo "tag $TAG_NAME not found" >&2; exit 1; }`,
+		"status=0",
+		`git `+config+`tag -v "$TAG_NAME" 2>&1 || status=$?`,
+		`echo "`+verifyTagStatusPrefix+`$status"`,
+	)
+	return strings.Join(commands, "\n"), nil
+}
+
+// verifyTagResult splits the output of verifyTagScript into the output of `git tag -v`,
+// and ErrInvalidTagSignature if it failed.
+func verifyTagResult(tag, output string) (string, error) {
+	output = strings.TrimRight(output, "\n")
+	i := strings.LastIndex(output, verifyTagStatusPrefix)
+	if i < 0 {
+		return "", fmt.Errorf("ERROR: could not verify tag %s: no status in output: %s", tag, output)
+	}
+	status := output[i+len(verifyTagStatusPrefix):]
+	output = strings.TrimRight(output[:i], "\n")
+	if status != "0" {
+		return output, fmt.Errorf("%w tag: %s; reason: %s", ErrInvalidTagSignature, tag, output)
+	}
+	return output, nil
+}
+
+// VerifyGitTag checks the signature of tag in repoDir and returns the output of `git tag -v`.
+// A bad or missing signature is ErrInvalidTagSignature, unlike a missing tag or tools.
+func VerifyGitTag(repoDir *dagger.Directory, tag string, opts VerifyTagOptions, container *dagger.Container, c *dagger.Client, ctx context.Context) (string, error) {
+	script, err := verifyTagScript(opts.Format, "/tmp/go-pipeline-trusted-keys")
+	if err != nil {
+		return "", err
+	}
+
+	output, err := container.WithEntrypoint([]string{}).
+		WithNewFile("/tmp/go-pipeline-trusted-keys", dagger.ContainerWithNewFileOpts{Contents: opts.TrustedKeys}).
+		WithMountedDirectory("/REPO", repoDir).
+		WithWorkdir("/REPO").
+		WithEnvVariable("TAG_NAME", tag).
+		WithExec([]string{"sh", "-c", script}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: could not verify tag %s: %s", tag, err)
+	}
+	return verifyTagResult(tag, output)
+}
@@ -0,0 +1,172 @@
+package pipeline
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The scripts run by CreateGitTag, PushGitTags and VerifyGitTag are run on the host here,
+// against a local bare repository.
+
+func requireCommands(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not available", name)
+		}
+	}
+}
+
+func runInDir(t *testing.T, dir string, env map[string]string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1", "GNUPGHOME="+t.TempDir())
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+func mustRunInDir(t *testing.T, dir string, env map[string]string, args ...string) string {
+	t.Helper()
+	out, err := runInDir(t, dir, env, args...)
+	if err != nil {
+		t.Fatalf("%v failed: %s: %s", args, err, out)
+	}
+	return out
+}
+
+// newTagTestRepos returns a work repository with one commit, and a bare repository as its "origin".
+func newTagTestRepos(t *testing.T) (work string, bare string) {
+	work, bare = t.TempDir(), t.TempDir()
+	mustRunInDir(t, bare, nil, "git", "init", "-q", "--bare")
+	mustRunInDir(t, work, nil, "git", "init", "-q")
+	mustRunInDir(t, work, nil, "git", "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "-q", "--allow-empty", "-m", "initial")
+	mustRunInDir(t, work, nil, "git", "remote", "add", "origin", bare)
+	return
+}
+
+func createAndPushTag(t *testing.T, work, tag string, opts CreateTagOptions, keyPath string) {
+	t.Helper()
+	script, env, err := createTagScript(tag, opts, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustRunInDir(t, work, env, "sh", "-c", script)
+	mustRunInDir(t, work, nil, pushTagsArgs("origin", []string{tag})...)
+}
+
+func verifyTag(t *testing.T, repo, tag string, format TagSigningFormat, trustedKeys string) (string, error) {
+	t.Helper()
+	keysPath := filepath.Join(t.TempDir(), "trusted-keys")
+	if err := os.WriteFile(keysPath, []byte(trustedKeys), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script, err := verifyTagScript(format, keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runInDir(t, repo, map[string]string{"TAG_NAME": tag}, "sh", "-c", script)
+	if err != nil {
+		return out, err
+	}
+	return verifyTagResult(tag, out)
+}
+
+func TestAnnotatedGitTag(t *testing.T) {
+	requireCommands(t, "git")
+	work, bare := newTagTestRepos(t)
+
+	createAndPushTag(t, work, "v1.0.0", CreateTagOptions{TaggerName: "Release Bot"}, "")
+
+	if kind := mustRunInDir(t, bare, nil, "git", "cat-file", "-t", "v1.0.0"); kind != "tag" {
+		t.Fatalf("expected an annotated tag in the remote, got a %s", kind)
+	}
+	if msg := mustRunInDir(t, bare, nil, "git", "tag", "-l", "--format=%(contents:subject)", "v1.0.0"); msg != "Release v1.0.0" {
+		t.Errorf("unexpected tag message: %q", msg)
+	}
+	if tagger := mustRunInDir(t, bare, nil, "git", "tag", "-l", "--format=%(taggername) %(taggeremail)", "v1.0.0"); tagger != "Release Bot <go-pipeline@localhost>" {
+		t.Errorf("unexpected tagger: %q", tagger)
+	}
+	if commit, head := mustRunInDir(t, bare, nil, "git", "rev-parse", "v1.0.0^{commit}"), mustRunInDir(t, work, nil, "git", "rev-parse", "HEAD"); commit != head {
+		t.Errorf("tag points at %s, expected HEAD %s", commit, head)
+	}
+
+	// an unsigned tag never passes verification
+	if out, err := verifyTag(t, bare, "v1.0.0", TagSigningSSH, ""); !errors.Is(err, ErrInvalidTagSignature) {
+		t.Errorf("expected the unsigned tag to be rejected, got: %v: %s", err, out)
+	}
+	// a missing tag is not a signature failure
+	if _, err := verifyTag(t, bare, "v9.9.9", TagSigningSSH, ""); err == nil || errors.Is(err, ErrInvalidTagSignature) {
+		t.Errorf("expected a missing tag to fail without ErrInvalidTagSignature, got %v", err)
+	}
+}
+
+func TestSSHSignedGitTag(t *testing.T) {
+	requireCommands(t, "git", "ssh-keygen")
+	work, bare := newTagTestRepos(t)
+
+	keys := t.TempDir()
+	signingKey, otherKey := filepath.Join(keys, "signing"), filepath.Join(keys, "other")
+	for _, key := range []string{signingKey, otherKey} {
+		mustRunInDir(t, keys, nil, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", key)
+	}
+	allowedSigners := func(key string) string {
+		pub, err := os.ReadFile(key + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "go-pipeline@localhost " + strings.TrimSpace(string(pub)) + "\n"
+	}
+
+	createAndPushTag(t, work, "v1.1.0", CreateTagOptions{SigningFormat: TagSigningSSH}, signingKey)
+
+	out, err := verifyTag(t, bare, "v1.1.0", TagSigningSSH, allowedSigners(signingKey))
+	if err != nil {
+		t.Fatalf("expected a valid signature: %s: %s", err, out)
+	}
+	if !strings.Contains(out, "Good") {
+		t.Errorf("unexpected verification output: %s", out)
+	}
+
+	if out, err = verifyTag(t, bare, "v1.1.0", TagSigningSSH, allowedSigners(otherKey)); !errors.Is(err, ErrInvalidTagSignature) {
+		t.Errorf("expected the signature to be rejected for an untrusted key, got: %v: %s", err, out)
+	}
+}
+
+func TestGPGSignedGitTag(t *testing.T) {
+	requireCommands(t, "git", "gpg")
+	work, bare := newTagTestRepos(t)
+
+	keys := t.TempDir()
+	// exportGPGKey generates a key in its own keyring, and returns the path of the armored secret key and the public key
+	exportGPGKey := func(email string) (string, string) {
+		env := map[string]string{"GNUPGHOME": t.TempDir()}
+		mustRunInDir(t, keys, env, "gpg", "--batch", "--passphrase", "", "--quick-gen-key", "Test <"+email+">", "ed25519", "sign", "never")
+		secret := filepath.Join(keys, email+".asc")
+		mustRunInDir(t, keys, env, "gpg", "--batch", "--armor", "--output", secret, "--export-secret-keys", email)
+		return secret, mustRunInDir(t, keys, env, "gpg", "--batch", "--armor", "--export", email)
+	}
+	signingKey, signingPub := exportGPGKey("signing@localhost")
+	_, otherPub := exportGPGKey("other@localhost")
+
+	createAndPushTag(t, work, "v1.2.0", CreateTagOptions{SigningFormat: TagSigningGPG}, signingKey)
+
+	out, err := verifyTag(t, bare, "v1.2.0", TagSigningGPG, signingPub)
+	if err != nil {
+		t.Fatalf("expected a valid signature: %s: %s", err, out)
+	}
+	if !strings.Contains(out, "Good signature") {
+		t.Errorf("unexpected verification output: %s", out)
+	}
+
+	if out, err = verifyTag(t, bare, "v1.2.0", TagSigningGPG, otherPub); !errors.Is(err, ErrInvalidTagSignature) {
+		t.Errorf("expected the signature to be rejected for an untrusted key, got: %v: %s", err, out)
+	}
+}
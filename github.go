@@ -40,6 +40,10 @@ type UploadUrlResponse struct {
 }
 
 func (gha *GitHubActions) UploadArtifact(ctx context.Context, repo string, runID int64, artifactName string, artifactPath string) error {
+	if err := RequireTrustedContext("upload artifact"); err != nil {
+		return err
+	}
+
 	apiUrl := fmt.Sprintf("https://api.github.com/repos/%s/actions/runs/%d/artifacts", repo, runID)
 
 	req, _ := http.NewRequest("GET", apiUrl, nil)
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUntrustedContext = errors.New("ERROR: refusing to run a secret-consuming step in an untrusted context.")
+)
+
+type GitHubEventRepo struct {
+	FullName string `json:"full_name"`
+	Fork     bool   `json:"fork"`
+}
+
+type GitHubEventRef struct {
+	Ref  string          `json:"ref"`
+	SHA  string          `json:"sha"`
+	Repo GitHubEventRepo `json:"repo"`
+}
+
+type GitHubEventPullRequest struct {
+	Number int            `json:"number"`
+	Head   GitHubEventRef `json:"head"`
+	Base   GitHubEventRef `json:"base"`
+}
+
+// GitHubEvent is the subset of the webhook payload at $GITHUB_EVENT_PATH that we care about.
+type GitHubEvent struct {
+	Before      string                  `json:"before"`
+	After       string                  `json:"after"`
+	PullRequest *GitHubEventPullRequest `json:"pull_request"`
+	Repository  GitHubEventRepo         `json:"repository"`
+}
+
+// GitHubContext mirrors the `github` context of a workflow run, read from the default environment variables.
+// See: https://docs.github.com/en/actions/learn-github-actions/variables#default-environment-variables
+type GitHubContext struct {
+	EventName  string
+	Repository string
+	Owner      string
+	Repo       string
+	SHA        string
+	Ref        string
+	HeadRef    string
+	BaseRef    string
+	Actor      string
+	ServerURL  string
+	RunID      int64
+	Event      GitHubEvent
+}
+
+func GetGitHubContext() (*GitHubContext, error) {
+	ghCtx := &GitHubContext{
+		EventName:  os.Getenv("GITHUB_EVENT_NAME"),
+		Repository: os.Getenv("GITHUB_REPOSITORY"),
+		SHA:        os.Getenv("GITHUB_SHA"),
+		Ref:        os.Getenv("GITHUB_REF"),
+		HeadRef:    os.Getenv("GITHUB_HEAD_REF"),
+		BaseRef:    os.Getenv("GITHUB_BASE_REF"),
+		Actor:      os.Getenv("GITHUB_ACTOR"),
+		ServerURL:  os.Getenv("GITHUB_SERVER_URL"),
+	}
+	ghCtx.Owner, ghCtx.Repo, _ = strings.Cut(ghCtx.Repository, "/")
+	if runID := os.Getenv("GITHUB_RUN_ID"); runID != "" {
+		ghCtx.RunID, _ = strconv.ParseInt(runID, 10, 64)
+	}
+
+	eventPath := os.Getenv("GITHUB_EVENT_PATH")
+	if eventPath == "" {
+		return ghCtx, nil
+	}
+	data, err := os.ReadFile(eventPath)
+	if err != nil {
+		return ghCtx, fmt.Errorf("ERROR: cannot read event payload: %s", err)
+	}
+	if err = json.Unmarshal(data, &ghCtx.Event); err != nil {
+		return ghCtx, fmt.Errorf("ERROR: cannot parse event payload: %s", err)
+	}
+
+	return ghCtx, nil
+}
+
+func IsGitHubActions() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+func IsPullRequestTarget() bool {
+	return os.Getenv("GITHUB_EVENT_NAME") == "pull_request_target"
+}
+
+// IsFork reports whether the pull request head lives in a different repository than its base.
+func (ghCtx *GitHubContext) IsFork() bool {
+	pr := ghCtx.Event.PullRequest
+	if pr == nil {
+		return false
+	}
+	return pr.Head.Repo.FullName != pr.Base.Repo.FullName
+}
+
+// trustedGitHubEvents only run code that is already in the repository, or was pushed by someone with write access.
+// Events like `workflow_run` or `issue_comment` can be triggered from forks and are not trusted.
+var trustedGitHubEvents = map[string]bool{
+	"push":                true,
+	"workflow_dispatch":   true,
+	"schedule":            true,
+	"release":             true,
+	"merge_group":         true,
+	"repository_dispatch": true,
+	"create":              true,
+	"delete":              true,
+}
+
+// HasTrustedSecrets reports whether secrets are available AND the checked out code can be trusted with them.
+// Fork PRs run without secrets under `pull_request`, and with secrets but untrusted code under `pull_request_target`.
+// Dependabot only gets a read-only token. Events missing from trustedGitHubEvents are never trusted.
+func (ghCtx *GitHubContext) HasTrustedSecrets() bool {
+	if ghCtx.Actor == "dependabot[bot]" {
+		return false
+	}
+	switch ghCtx.EventName {
+	case "pull_request", "pull_request_target", "pull_request_review", "pull_request_review_comment":
+		return !ghCtx.IsFork()
+	default:
+		return trustedGitHubEvents[ghCtx.EventName]
+	}
+}
+
+func IsForkPullRequest() bool {
+	ghCtx, err := GetGitHubContext()
+	if err != nil {
+		return false
+	}
+	return ghCtx.IsFork()
+}
+
+// HasTrustedSecrets is always true outside of GitHub Actions, e.g. for local runs.
+func HasTrustedSecrets() bool {
+	if !IsGitHubActions() {
+		return true
+	}
+	ghCtx, err := GetGitHubContext()
+	if err != nil {
+		// can't tell, so assume the worst
+		return false
+	}
+	return ghCtx.HasTrustedSecrets()
+}
+
+// RequireTrustedContext guards secret-consuming steps, such as releases and artifact uploads.
+func RequireTrustedContext(step string) error {
+	if !HasTrustedSecrets() {
+		return fmt.Errorf("%w step: '%s', event: '%s'", ErrUntrustedContext, step, os.Getenv("GITHUB_EVENT_NAME"))
+	}
+	return nil
+}
+
+func (gha *GitHubActions) ActorHasWritePermission(ctx context.Context, owner string, repo string, actor string) (bool, error) {
+	level, _, err := gha.Client.Repositories.GetPermissionLevel(ctx, owner, repo, actor)
+	if err != nil {
+		return false, err
+	}
+
+	switch level.GetPermission() {
+	case "admin", "maintain", "write":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
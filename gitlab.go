@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const gitLabPerPage = 100
+
+// GitLab is a small client for the GitLab REST API, covering what CommentOrUpdatePR and friends do for GitHub.
+type GitLab struct {
+	// e.g. https://gitlab.com/api/v4, see CI_API_V4_URL
+	BaseURL string
+	Token   string
+	// "PRIVATE-TOKEN" for personal/project access tokens, or "JOB-TOKEN" for CI_JOB_TOKEN.
+	TokenHeader string
+	HTTPClient  *http.Client
+}
+
+func NewGitLab(baseURL, token string) *GitLab {
+	return &GitLab{
+		BaseURL:     strings.TrimSuffix(baseURL, "/"),
+		Token:       token,
+		TokenHeader: "PRIVATE-TOKEN",
+		HTTPClient:  http.DefaultClient,
+	}
+}
+
+// NewGitLabFromEnv uses GITLAB_TOKEN, falling back to the (more restricted) CI_JOB_TOKEN.
+func NewGitLabFromEnv() (*GitLab, error) {
+	baseURL := os.Getenv("CI_API_V4_URL")
+	if baseURL == "" {
+		baseURL = "https://gitlab.com/api/v4"
+	}
+
+	if token := os.Getenv("GITLAB_TOKEN"); token != "" {
+		return NewGitLab(baseURL, token), nil
+	}
+	if token := os.Getenv("CI_JOB_TOKEN"); token != "" {
+		gl := NewGitLab(baseURL, token)
+		gl.TokenHeader = "JOB-TOKEN"
+		return gl, nil
+	}
+	return nil, ErrMissingToken
+}
+
+// GitLabContext holds the predefined CI_* variables of the running job.
+// See: https://docs.gitlab.com/ee/ci/variables/predefined_variables.html
+type GitLabContext struct {
+	APIURL          string
+	ProjectID       string
+	ProjectPath     string
+	ProjectURL      string
+	MergeRequestIID int
+	SHA             string
+	RefName         string
+	CommitTag       string
+	SourceBranch    string
+	JobID           int64
+	JobName         string
+	PipelineID      int64
+	PipelineURL     string
+}
+
+func GetGitLabContext() *GitLabContext {
+	glCtx := &GitLabContext{
+		APIURL:       os.Getenv("CI_API_V4_URL"),
+		ProjectID:    os.Getenv("CI_PROJECT_ID"),
+		ProjectPath:  os.Getenv("CI_PROJECT_PATH"),
+		ProjectURL:   os.Getenv("CI_PROJECT_URL"),
+		SHA:          os.Getenv("CI_COMMIT_SHA"),
+		RefName:      os.Getenv("CI_COMMIT_REF_NAME"),
+		CommitTag:    os.Getenv("CI_COMMIT_TAG"),
+		SourceBranch: os.Getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME"),
+		JobName:      os.Getenv("CI_JOB_NAME"),
+		PipelineURL:  os.Getenv("CI_PIPELINE_URL"),
+	}
+	glCtx.MergeRequestIID, _ = strconv.Atoi(os.Getenv("CI_MERGE_REQUEST_IID"))
+	glCtx.JobID, _ = strconv.ParseInt(os.Getenv("CI_JOB_ID"), 10, 64)
+	glCtx.PipelineID, _ = strconv.ParseInt(os.Getenv("CI_PIPELINE_ID"), 10, 64)
+	return glCtx
+}
+
+func (gl *GitLab) projectURL(projectID string) string {
+	// project IDs may also be paths, e.g. "group/project"
+	return fmt.Sprintf("%s/projects/%s", gl.BaseURL, url.PathEscape(projectID))
+}
+
+func (gl *GitLab) headers() map[string]string {
+	return map[string]string{gl.TokenHeader: gl.Token}
+}
+
+func (gl *GitLab) do(ctx context.Context, method, apiURL string, in, out interface{}) error {
+	return DoJSONRequest(ctx, gl.HTTPClient, method, apiURL, gl.headers(), in, out)
+}
+
+type GitLabNote struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+func (gl *GitLab) ListMergeRequestNotes(ctx context.Context, projectID string, mrIID int) (notes []GitLabNote, err error) {
+	for page := 1; ; page++ {
+		var pageNotes []GitLabNote
+		notesURL := fmt.Sprintf("%s/merge_requests/%d/notes?per_page=%d&page=%d", gl.projectURL(projectID), mrIID, gitLabPerPage, page)
+		if err = gl.do(ctx, http.MethodGet, notesURL, nil, &pageNotes); err != nil {
+			return
+		}
+		notes = append(notes, pageNotes...)
+		if len(pageNotes) < gitLabPerPage {
+			return
+		}
+	}
+}
+
+// CommentOrUpdateMR keeps a single "sticky" note on the merge request, found by identifier.
+func (gl *GitLab) CommentOrUpdateMR(ctx context.Context, projectID string, mrIID int, newComment string, identifier string) error {
+	notes, err := gl.ListMergeRequestNotes(ctx, projectID, mrIID)
+	if err != nil {
+		return err
+	}
+
+	notesURL := fmt.Sprintf("%s/merge_requests/%d/notes", gl.projectURL(projectID), mrIID)
+	note := map[string]string{"body": newComment}
+	for _, n := range notes {
+		if strings.Contains(n.Body, identifier) {
+			return gl.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesURL, n.ID), note, nil)
+		}
+	}
+
+	return gl.do(ctx, http.MethodPost, notesURL, note, nil)
+}
+
+func (gl *GitLab) GetOpenMergeRequestIIDForBranch(ctx context.Context, projectID string, branch string) (int, error) {
+	var mrs []struct {
+		IID          int    `json:"iid"`
+		SourceBranch string `json:"source_branch"`
+	}
+	mrsURL := fmt.Sprintf("%s/merge_requests?state=opened&source_branch=%s", gl.projectURL(projectID), url.QueryEscape(branch))
+	if err := gl.do(ctx, http.MethodGet, mrsURL, nil, &mrs); err != nil {
+		return 0, err
+	}
+
+	for _, mr := range mrs {
+		if mr.SourceBranch == branch {
+			return mr.IID, nil
+		}
+	}
+	return 0, ErrNoOpenPullRequests
+}
+
+// GitLabCommitStatus State is one of pending, running, success, failed or canceled.
+type GitLabCommitStatus struct {
+	State       string `json:"state"`
+	Ref         string `json:"ref,omitempty"`
+	Name        string `json:"name,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	PipelineID  int64  `json:"pipeline_id,omitempty"`
+}
+
+func (gl *GitLab) SetCommitStatus(ctx context.Context, projectID string, sha string, status GitLabCommitStatus) error {
+	statusURL := fmt.Sprintf("%s/statuses/%s", gl.projectURL(projectID), sha)
+	return gl.do(ctx, http.MethodPost, statusURL, status, nil)
+}
+
+type GitLabVariable struct {
+	Key          string `json:"key"`
+	Value        string `json:"value"`
+	VariableType string `json:"variable_type"`
+}
+
+func (gl *GitLab) GetPipelineVariables(ctx context.Context, projectID string, pipelineID int64) (vars []GitLabVariable, err error) {
+	varsURL := fmt.Sprintf("%s/pipelines/%d/variables", gl.projectURL(projectID), pipelineID)
+	err = gl.do(ctx, http.MethodGet, varsURL, nil, &vars)
+	return
+}
+
+// DownloadJobArtifacts saves the artifacts archive (zip) of a job to destination.
+func (gl *GitLab) DownloadJobArtifacts(ctx context.Context, projectID string, jobID int64, destination string) error {
+	artifactsURL := fmt.Sprintf("%s/jobs/%d/artifacts", gl.projectURL(projectID), jobID)
+	return gl.download(ctx, artifactsURL, destination)
+}
+
+// DownloadLatestJobArtifacts saves the artifacts archive of the latest successful job named jobName on ref.
+func (gl *GitLab) DownloadLatestJobArtifacts(ctx context.Context, projectID string, ref string, jobName string, destination string) error {
+	artifactsURL := fmt.Sprintf("%s/jobs/artifacts/%s/download?job=%s", gl.projectURL(projectID), url.PathEscape(ref), url.QueryEscape(jobName))
+	return gl.download(ctx, artifactsURL, destination)
+}
+
+func (gl *GitLab) download(ctx context.Context, downloadURL string, destination string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range gl.headers() {
+		req.Header.Set(k, v)
+	}
+
+	client := gl.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &HTTPError{Method: req.Method, URL: downloadURL, StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(msg))}
+	}
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
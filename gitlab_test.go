@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitLab serves the merge request notes API of a single project from memory.
+type fakeGitLab struct {
+	mu       sync.Mutex
+	notes    []GitLabNote
+	requests []string
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("PRIVATE-TOKEN") != "token" {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	notesPath := "/api/v4/projects/group%2Fproject/merge_requests/7/notes"
+	switch {
+	case r.Method == http.MethodGet && r.URL.EscapedPath() == notesPath:
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		start := (page - 1) * perPage
+		if start > len(f.notes) {
+			start = len(f.notes)
+		}
+		end := start + perPage
+		if end > len(f.notes) {
+			end = len(f.notes)
+		}
+		_ = json.NewEncoder(w).Encode(f.notes[start:end])
+	case r.Method == http.MethodPost && r.URL.EscapedPath() == notesPath:
+		var note GitLabNote
+		_ = json.NewDecoder(r.Body).Decode(&note)
+		note.ID = int64(len(f.notes) + 1)
+		f.notes = append(f.notes, note)
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(note)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.EscapedPath(), notesPath+"/"):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.EscapedPath(), notesPath+"/"), 10, 64)
+		var note GitLabNote
+		_ = json.NewDecoder(r.Body).Decode(&note)
+		for i := range f.notes {
+			if f.notes[i].ID == id {
+				f.notes[i].Body = note.Body
+				_ = json.NewEncoder(w).Encode(f.notes[i])
+				return
+			}
+		}
+		http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+	default:
+		http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+	}
+}
+
+func newFakeGitLab(t *testing.T) (*fakeGitLab, *GitLab) {
+	fake := &fakeGitLab{}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, NewGitLab(server.URL+"/api/v4/", "token")
+}
+
+func TestGitLabCommentOrUpdateMR(t *testing.T) {
+	fake, gl := newFakeGitLab(t)
+	ctx := context.Background()
+
+	if err := gl.CommentOrUpdateMR(ctx, "group/project", 7, "first <!-- sticky -->", "<!-- sticky -->"); err != nil {
+		t.Fatal(err)
+	}
+	if err := gl.CommentOrUpdateMR(ctx, "group/project", 7, "second <!-- sticky -->", "<!-- sticky -->"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.notes) != 1 {
+		t.Fatalf("expected a single note, got %d", len(fake.notes))
+	}
+	if fake.notes[0].Body != "second <!-- sticky -->" {
+		t.Errorf("note was not updated: %q", fake.notes[0].Body)
+	}
+	if last := fake.requests[len(fake.requests)-1]; !strings.HasPrefix(last, http.MethodPut) {
+		t.Errorf("expected the second comment to update the note, got %s", last)
+	}
+}
+
+func TestGitLabListMergeRequestNotesPagination(t *testing.T) {
+	fake, gl := newFakeGitLab(t)
+	ctx := context.Background()
+
+	total := gitLabPerPage*2 + 5
+	for i := 1; i <= total; i++ {
+		fake.notes = append(fake.notes, GitLabNote{ID: int64(i), Body: fmt.Sprintf("note %d", i)})
+	}
+	fake.notes[total-1].Body = "old <!-- sticky -->"
+
+	notes, err := gl.ListMergeRequestNotes(ctx, "group/project", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != total {
+		t.Fatalf("expected %d notes, got %d", total, len(notes))
+	}
+
+	// the sticky note is on the last page, so it must be updated rather than duplicated
+	if err = gl.CommentOrUpdateMR(ctx, "group/project", 7, "new <!-- sticky -->", "<!-- sticky -->"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.notes) != total {
+		t.Fatalf("expected %d notes, got %d", total, len(fake.notes))
+	}
+	if fake.notes[total-1].Body != "new <!-- sticky -->" {
+		t.Errorf("note on the last page was not updated: %q", fake.notes[total-1].Body)
+	}
+}
+
+func TestGitLabHTTPError(t *testing.T) {
+	_, gl := newFakeGitLab(t)
+	gl.Token = "wrong"
+
+	err := gl.SetCommitStatus(context.Background(), "group/project", "abc123", GitLabCommitStatus{State: "success"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected an HTTPError, got %v", err)
+	}
+	if httpErr.StatusCode != http.StatusUnauthorized || httpErr.Method != http.MethodPost {
+		t.Errorf("unexpected error: %+v", httpErr)
+	}
+	if !strings.Contains(httpErr.Body, "401 Unauthorized") {
+		t.Errorf("expected the response body in the error, got %q", httpErr.Body)
+	}
+}
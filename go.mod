@@ -5,6 +5,8 @@ go 1.20
 require (
 	dagger.io/dagger v0.8.8
 	github.com/google/go-github/v56 v56.0.0
+	github.com/google/uuid v1.3.1
+	golang.org/x/crypto v0.14.0
 	golang.org/x/mod v0.13.0
 	golang.org/x/oauth2 v0.13.0
 	golang.org/x/sync v0.4.0
@@ -16,7 +18,6 @@ require (
 	github.com/adrg/xdg v0.4.0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/google/uuid v1.3.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/sosodev/duration v1.2.0 // indirect
 	github.com/vektah/gqlparser/v2 v2.5.10 // indirect
@@ -0,0 +1,172 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// GoModule is a Go module inside a (mono)repo.
+type GoModule struct {
+	// Module path from go.mod, e.g. github.com/jerusj/go-pipeline/v2
+	Path string
+	// Slash-separated directory relative to the repo root, "." for the root module.
+	Dir string
+}
+
+// TagPrefix is the prefix Go expects for the version tags of the module, e.g. "ci/" for ci/v1.2.0.
+// See: https://go.dev/ref/mod#vcs-version
+func (m GoModule) TagPrefix() string {
+	if m.Dir == "." {
+		return ""
+	}
+	return m.Dir + "/"
+}
+
+func (m GoModule) Tag(version string) string {
+	return m.TagPrefix() + version
+}
+
+// ValidateVersion checks the major version against the /vN suffix of the module path.
+func (m GoModule) ValidateVersion(version string) error {
+	_, pathMajor, ok := module.SplitPathVersion(m.Path)
+	if !ok {
+		return fmt.Errorf("ERROR: invalid module path: '%s'", m.Path)
+	}
+	if err := module.CheckPathMajor(version, pathMajor); err != nil {
+		return fmt.Errorf("ERROR: cannot release %s as %s, the major version must match the module path suffix: %s", m.Path, version, err)
+	}
+	return nil
+}
+
+// InitialVersion is the first version allowed by the module path, e.g. v2.0.0 for a /v2 module.
+func (m GoModule) InitialVersion() string {
+	_, pathMajor, _ := module.SplitPathVersion(m.Path)
+	if pathMajor == "" {
+		return "v1.0.0"
+	}
+	return module.PathMajorPrefix(pathMajor) + ".0.0"
+}
+
+// DetectGoModules finds every go.mod below root on the host, skipping vendor and testdata directories.
+func DetectGoModules(root string) (modules []GoModule, err error) {
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case ".git", "vendor", "testdata", "node_modules":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "go.mod" {
+			return nil
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		modFile, err := modfile.ParseLax(p, data, nil)
+		if err != nil {
+			return err
+		}
+		if modFile.Module == nil {
+			return fmt.Errorf("ERROR: no module directive in: %s", p)
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		modules = append(modules, GoModule{Path: modFile.Module.Mod.Path, Dir: filepath.ToSlash(rel)})
+		return nil
+	})
+
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Dir < modules[j].Dir })
+	return
+}
+
+// modulePaths returns the git pathspecs for the commits of m, leaving out the modules nested in it.
+func modulePaths(m GoModule, modules []GoModule) []string {
+	paths := []string{m.Dir}
+	for _, other := range modules {
+		if other.Dir == m.Dir {
+			continue
+		}
+		if m.Dir == "." || strings.HasPrefix(other.Dir, m.Dir+"/") {
+			paths = append(paths, ":(exclude)"+path.Clean(other.Dir))
+		}
+	}
+	return paths
+}
+
+type ModuleRelease struct {
+	Module GoModule
+	*VersionResult
+}
+
+// CalculateModuleVersions computes the next version of every module from the commits touching its directory,
+// and checks the result against the module path.
+func CalculateModuleVersions(repoDir *dagger.Directory, modules []GoModule, opts VersionOptions, container *dagger.Container, c *dagger.Client, ctx context.Context) (releases []ModuleRelease, err error) {
+	for _, m := range modules {
+		modOpts := opts
+		modOpts.TagPrefix = m.TagPrefix()
+		modOpts.Paths = modulePaths(m, modules)
+		if modOpts.InitialVersion == "" {
+			modOpts.InitialVersion = m.InitialVersion()
+		}
+
+		result, err := CalculateNextVersion(repoDir, modOpts, container, c, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if result.NewRelease {
+			if err = m.ValidateVersion(result.Version); err != nil {
+				return nil, err
+			}
+		}
+		releases = append(releases, ModuleRelease{Module: m, VersionResult: result})
+	}
+	return
+}
+
+// TagModuleReleases creates an annotated tag on HEAD for every new release and returns the updated repoDir.
+// The container needs git.
+func TagModuleReleases(repoDir *dagger.Directory, releases []ModuleRelease, container *dagger.Container, c *dagger.Client, ctx context.Context) (*dagger.Directory, error) {
+	ctr := container.
+		WithMountedDirectory("/REPO", repoDir).
+		WithWorkdir("/REPO")
+
+	tagged := 0
+	for _, r := range releases {
+		if !r.NewRelease {
+			continue
+		}
+		ctr = ctr.WithExec([]string{
+			"git", "-c", "user.name=go-pipeline", "-c", "user.email=go-pipeline@localhost",
+			"tag", "-a", r.Tag, "-m", fmt.Sprintf("Release %s %s", r.Module.Path, r.Version),
+		})
+		tagged++
+	}
+	if tagged == 0 {
+		return repoDir, nil
+	}
+
+	ctr, err := ctr.Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: could not create module tags: %s", err)
+	}
+	return ctr.Directory("/REPO"), nil
+}
@@ -0,0 +1,321 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// See: https://slsa.dev/spec/v1.0/provenance and https://github.com/secure-systems-lab/dsse
+const (
+	InTotoStatementType     = "https://in-toto.io/Statement/v1"
+	SLSAProvenancePredicate = "https://slsa.dev/provenance/v1"
+	InTotoPayloadType       = "application/vnd.in-toto+json"
+	DefaultBuildType        = "https://github.com/jerusj/go-pipeline/buildtypes/dagger/v1"
+)
+
+var (
+	ErrUnexpectedPayloadType = errors.New("ERROR: unexpected DSSE payload type.")
+)
+
+// ResolvedTool is a binary downloaded into a container, see ToolRecorder.
+type ResolvedTool struct {
+	Name    string
+	Version string
+	URL     string
+	// Digest of the downloaded file, before extraction
+	SHA256 string
+}
+
+// ToolRecorder collects the binaries downloaded for one build, to pass on to its provenance.
+// Use one recorder per build, so concurrent pipelines don't mix their tools.
+type ToolRecorder struct {
+	mu    sync.Mutex
+	tools map[string]ResolvedTool
+}
+
+func NewToolRecorder() *ToolRecorder {
+	return &ToolRecorder{tools: map[string]ResolvedTool{}}
+}
+
+func (r *ToolRecorder) Record(tool ResolvedTool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[tool.URL] = tool
+}
+
+// Tools lists the recorded binaries, sorted by URL.
+func (r *ToolRecorder) Tools() []ResolvedTool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tools := make([]ResolvedTool, 0, len(r.tools))
+	for _, t := range r.tools {
+		tools = append(tools, t)
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].URL < tools[j].URL })
+	return tools
+}
+
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     ProvenancePredicate  `json:"predicate"`
+}
+
+type ProvenancePredicate struct {
+	BuildDefinition struct {
+		BuildType            string                 `json:"buildType"`
+		ExternalParameters   map[string]interface{} `json:"externalParameters"`
+		InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+		ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string     `json:"invocationId,omitempty"`
+			StartedOn    *time.Time `json:"startedOn,omitempty"`
+			FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+type ProvenanceOptions struct {
+	// Defaults to the hosted runner of the CI provider.
+	BuilderID string
+	// Defaults to DefaultBuildType
+	BuildType          string
+	ExternalParameters map[string]interface{}
+	StartedOn          time.Time
+	// Defaults to now
+	FinishedOn time.Time
+	// Binaries used by the build, see ToolRecorder.Tools
+	Tools []ResolvedTool
+}
+
+var defaultBuilderIDs = map[string]string{
+	"github":    "https://github.com/actions/runner",
+	"gitlab":    "https://gitlab.com/gitlab-org/gitlab-runner",
+	"bitbucket": "https://bitbucket.org/product/features/pipelines",
+	"local":     "https://github.com/jerusj/go-pipeline/local",
+}
+
+// FileSubject describes an artifact on the host by its sha256 digest.
+func FileSubject(path string) (ResourceDescriptor, error) {
+	sum, err := sha256File(path)
+	if err != nil {
+		return ResourceDescriptor{}, err
+	}
+	return ResourceDescriptor{Name: filepath.Base(path), Digest: map[string]string{"sha256": sum}}, nil
+}
+
+// ImageSubject describes an image from the reference returned by Container.Publish, e.g. "ghcr.io/o/r:tag@sha256:...".
+func ImageSubject(ref string) (ResourceDescriptor, error) {
+	name, digest, ok := strings.Cut(ref, "@sha256:")
+	if !ok {
+		return ResourceDescriptor{}, fmt.Errorf("ERROR: image reference has no sha256 digest: '%s'", ref)
+	}
+	// the digest covers the repository, not the tag
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return ResourceDescriptor{Name: name, Digest: map[string]string{"sha256": digest}}, nil
+}
+
+// NewProvenanceStatement records the subjects as built from the source of the CI context.
+func NewProvenanceStatement(subjects []ResourceDescriptor, provider CIProvider, opts ProvenanceOptions) *ProvenanceStatement {
+	stmt := &ProvenanceStatement{
+		Type:          InTotoStatementType,
+		Subject:       subjects,
+		PredicateType: SLSAProvenancePredicate,
+	}
+	def := &stmt.Predicate.BuildDefinition
+	run := &stmt.Predicate.RunDetails
+
+	def.BuildType = opts.BuildType
+	if def.BuildType == "" {
+		def.BuildType = DefaultBuildType
+	}
+	def.ExternalParameters = map[string]interface{}{}
+	for k, v := range opts.ExternalParameters {
+		def.ExternalParameters[k] = v
+	}
+
+	repoURL, sha, ref := provider.RepositoryURL(), provider.CommitSHA(), provider.Ref()
+	if repoURL != "" {
+		source := map[string]string{"repository": repoURL}
+		uri := "git+" + repoURL
+		if ref != "" {
+			source["ref"] = ref
+			uri += "@" + ref
+		}
+		def.ExternalParameters["source"] = source
+
+		dep := ResourceDescriptor{URI: uri}
+		if sha != "" {
+			dep.Digest = map[string]string{"gitCommit": sha}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, dep)
+	}
+
+	for _, t := range opts.Tools {
+		dep := ResourceDescriptor{Name: t.Name, URI: t.URL}
+		if t.SHA256 != "" {
+			dep.Digest = map[string]string{"sha256": t.SHA256}
+		}
+		if t.Version != "" {
+			dep.Annotations = map[string]string{"version": t.Version}
+		}
+		def.ResolvedDependencies = append(def.ResolvedDependencies, dep)
+	}
+
+	run.Builder.ID = opts.BuilderID
+	if run.Builder.ID == "" {
+		run.Builder.ID = defaultBuilderIDs[provider.Name()]
+	}
+	run.Metadata.InvocationID = provider.BuildURL()
+	if !opts.StartedOn.IsZero() {
+		started := opts.StartedOn.UTC()
+		run.Metadata.StartedOn = &started
+	}
+	finished := opts.FinishedOn
+	if finished.IsZero() {
+		finished = time.Now()
+	}
+	finished = finished.UTC()
+	run.Metadata.FinishedOn = &finished
+
+	return stmt
+}
+
+type DSSESignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+type DSSEEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []DSSESignature `json:"signatures"`
+}
+
+// dssePAE is the pre-authentication encoding the signature is computed over.
+func dssePAE(payloadType string, payload []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// SignProvenance wraps the statement in a DSSE envelope signed with the ed25519 key.
+func SignProvenance(stmt *ProvenanceStatement, key *SigningKey) (*DSSEEnvelope, error) {
+	payload, err := json.Marshal(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := ed25519.Sign(key.PrivateKey, dssePAE(InTotoPayloadType, payload))
+	return &DSSEEnvelope{
+		PayloadType: InTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []DSSESignature{{KeyID: keyIDString(key.KeyID), Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// VerifyProvenance checks that the envelope has a valid signature from key and returns its statement.
+func VerifyProvenance(env *DSSEEnvelope, key *VerifyingKey) (*ProvenanceStatement, error) {
+	if env.PayloadType != InTotoPayloadType {
+		return nil, fmt.Errorf("%w got: '%s'", ErrUnexpectedPayloadType, env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: invalid DSSE payload: %s", err)
+	}
+
+	pae := dssePAE(env.PayloadType, payload)
+	verified := false
+	for _, s := range env.Signatures {
+		if s.KeyID != "" && s.KeyID != keyIDString(key.KeyID) {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && ed25519.Verify(key.PublicKey, pae, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidSignature
+	}
+
+	stmt := &ProvenanceStatement{}
+	if err = json.Unmarshal(payload, stmt); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// WriteProvenance stores the envelope next to the artifact, as artifact.intoto.jsonl.
+func WriteProvenance(artifactPath string, env *DSSEEnvelope) (provenancePath string, err error) {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	provenancePath = artifactPath + ".intoto.jsonl"
+	err = os.WriteFile(provenancePath, append(data, '\n'), 0644)
+	return
+}
+
+// ReadProvenance reads the first envelope of a .intoto.jsonl file.
+func ReadProvenance(provenancePath string) (*DSSEEnvelope, error) {
+	data, err := os.ReadFile(provenancePath)
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+
+	env := &DSSEEnvelope{}
+	if err = json.Unmarshal([]byte(line), env); err != nil {
+		return nil, fmt.Errorf("ERROR: invalid provenance file %s: %s", provenancePath, err)
+	}
+	return env, nil
+}
+
+// AttestArtifacts writes a signed provenance statement next to every artifact and returns their paths.
+func AttestArtifacts(files []string, key *SigningKey, provider CIProvider, opts ProvenanceOptions) (paths []string, err error) {
+	for _, f := range files {
+		subject, err := FileSubject(f)
+		if err != nil {
+			return nil, err
+		}
+		env, err := SignProvenance(NewProvenanceStatement([]ResourceDescriptor{subject}, provider, opts), key)
+		if err != nil {
+			return nil, err
+		}
+		p, err := WriteProvenance(f, env)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return
+}
@@ -4,75 +4,205 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
 	"dagger.io/dagger"
 )
 
-// For config, see: https://github.com/semantic-release/semantic-release/blob/master/docs/usage/ci-configuration.md
-func RunSemanticRelease(repoDir *dagger.Directory, platform string, c *dagger.Client, ctx context.Context) (err error) {
-	c = c.Pipeline("Semantic Release")
+var (
+	ansiRegex                 = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	releaseNextVersionRegex   = regexp.MustCompile(`The next release version is (\S+)`)
+	releaseLastVersionRegex   = regexp.MustCompile(`associated with version (\S+)`)
+	releasePublishedRegex     = regexp.MustCompile(`Published release (\S+)`)
+	releaseNotesHeaderRegex   = regexp.MustCompile(`Release note for version \S+:`)
+	releaseNoChangesSubstring = "There are no relevant changes, so no new version is released"
+)
 
-	imageNode := "docker.io/node:20.6.1-alpine3.18"
-	npmPkgs := []string{
-		"semantic-release@v22.0.0",
-		"@semantic-release/release-notes-generator@latest",
-		"@semantic-release/npm@latest",
-		"@semantic-release/exec@latest",
-		"@semantic-release/changelog@latest",
-		"@semantic-release/git@latest",
-	}
+// DefaultSemanticReleasePlugins pins the plugin versions installed by RunSemanticRelease,
+// unless overridden by SemanticReleaseOptions.PluginVersions.
+var DefaultSemanticReleasePlugins = map[string]string{
+	"semantic-release":                          "22.0.0",
+	"@semantic-release/release-notes-generator": "12.0.0",
+	"@semantic-release/npm":                     "11.0.0",
+	"@semantic-release/exec":                    "6.0.3",
+	"@semantic-release/changelog":               "6.0.3",
+	"@semantic-release/git":                     "10.0.1",
+	"@semantic-release/github":                  "9.2.1",
+	"@semantic-release/gitlab":                  "12.0.6",
+	"@semantic-release/bitbucket":               "1.0.0",
+}
 
-	secretEnv := ""
-	switch platform {
+type SemanticReleaseOptions struct {
+	// One of "github", "gitlab" or "bitbucket".
+	Platform string
+	// Compute the next version and notes without publishing anything.
+	DryRun bool
+	Debug  bool
+	// Extra plugins to install, e.g. "semantic-release-slack-bot".
+	Plugins []string
+	// Package name to version, overrides DefaultSemanticReleasePlugins. Packages without a version use "latest".
+	PluginVersions map[string]string
+	// Release branches, overrides the `branches` of the semantic-release config when set.
+	Branches []string
+	// Defaults to docker.io/node:20.6.1-alpine3.18
+	Image string
+	Env   map[string]string
+	// Token for the platform, see TokenEnvVar. Defaults to reading that env var from the host.
+	Token *dagger.Secret
+}
+
+// TokenEnvVar is the env var semantic-release reads the platform token from.
+func (o SemanticReleaseOptions) TokenEnvVar() string {
+	return map[string]string{
+		"github":    "GITHUB_TOKEN",
+		"gitlab":    "GITLAB_TOKEN",
+		"bitbucket": "BITBUCKET_TOKEN",
+	}[o.Platform]
+}
+
+type SemanticReleaseResult struct {
+	LastVersion string
+	NextVersion string
+	// False for dry-runs, and when there are no relevant changes.
+	Released bool
+	// Only available for dry-runs, semantic-release doesn't log them otherwise.
+	Notes string
+	// Full output of the run
+	Output string
+}
+
+func (o SemanticReleaseOptions) packages() ([]string, error) {
+	names := []string{
+		"semantic-release",
+		"@semantic-release/release-notes-generator",
+		"@semantic-release/npm",
+		"@semantic-release/exec",
+		"@semantic-release/changelog",
+		"@semantic-release/git",
+	}
+	switch o.Platform {
 	case "github":
 		// NOTE, see: https://docs.github.com/en/repositories/managing-your-repositorys-settings-and-features/enabling-features-for-your-repository/managing-github-actions-settings-for-a-repository#setting-the-permissions-of-the-github_token-for-your-repository
 		// The default GITHUB_TOKEN generated in CI only has 'read' access, thus Semantic Release will fail.
-		secretEnv = "GITHUB_TOKEN"
-		npmPkgs = append(npmPkgs, "@semantic-release/github@latest")
+		names = append(names, "@semantic-release/github")
 	case "gitlab":
-		secretEnv = "GITLAB_TOKEN"
-		npmPkgs = append(npmPkgs, "@semantic-release/gitlab@latest")
+		names = append(names, "@semantic-release/gitlab")
 	case "bitbucket":
-		secretEnv = "BITBUCKET_TOKEN"
-		npmPkgs = append(npmPkgs, "@semantic-release/bitbucket@latest")
+		names = append(names, "@semantic-release/bitbucket")
 	default:
-		err = fmt.Errorf("ERROR: unsupported platform, can't run semantic release. Supplied platform: '%s' ", platform)
+		return nil, fmt.Errorf("ERROR: unsupported platform, can't run semantic release. Supplied platform: '%s' ", o.Platform)
+	}
+	names = append(names, o.Plugins...)
+
+	pkgs := make([]string, 0, len(names))
+	for _, name := range names {
+		version := "latest"
+		if v, ok := DefaultSemanticReleasePlugins[name]; ok {
+			version = v
+		}
+		if v, ok := o.PluginVersions[name]; ok {
+			version = v
+		}
+		pkgs = append(pkgs, fmt.Sprintf("%s@%s", name, version))
+	}
+	return pkgs, nil
+}
+
+func (o SemanticReleaseOptions) command() string {
+	args := []string{"npx", "semantic-release", fmt.Sprintf("--dry-run=%t", o.DryRun)}
+	if os.Getenv("CI") == "" {
+		// semantic-release refuses to publish outside of CI otherwise
+		args = append(args, "--no-ci")
+	}
+	if o.Debug {
+		args = append(args, "--debug")
+	}
+	if len(o.Branches) > 0 {
+		args = append(args, "--branches")
+		args = append(args, o.Branches...)
+	}
+	// the logs are split between stdout and stderr
+	return strings.Join(args, " ") + " 2>&1"
+}
+
+// For config, see: https://github.com/semantic-release/semantic-release/blob/master/docs/usage/ci-configuration.md
+func RunSemanticRelease(repoDir *dagger.Directory, opts SemanticReleaseOptions, c *dagger.Client, ctx context.Context) (result *SemanticReleaseResult, err error) {
+	c = c.Pipeline("Semantic Release")
+
+	if err = RequireTrustedContext("semantic release"); err != nil {
 		return
 	}
 
-	// TODO: use *dagger.Secret for token
-	token := os.Getenv(secretEnv)
-	if token == "" {
-		err = fmt.Errorf("ERROR: empty token for env var: %s", secretEnv)
+	if opts.Image == "" {
+		opts.Image = "docker.io/node:20.6.1-alpine3.18"
+	}
+	npmPkgs, err := opts.packages()
+	if err != nil {
 		return
 	}
 
-	// Always release under CI
-	isDryRun := true
-	ciEnv := os.Getenv("CI")
-	if ciEnv != "" {
-		isDryRun = false
+	secretEnv := opts.TokenEnvVar()
+	token := opts.Token
+	if token == nil {
+		token, err = SecretFromEnv(secretEnv, secretEnv, c)
+		if err != nil {
+			return
+		}
 	}
 
-	cSemantic := c.Container().From(imageNode).
+	cSemantic := c.Container().From(opts.Image).
 		WithEntrypoint([]string{"sh", "-c"}).
 		WithMountedCache("/var/cache/apk", c.CacheVolume("apk_cache")).
 		WithExec([]string{"apk update"}).
 		WithExec([]string{"apk add git git-lfs"}).
+		WithExec([]string{"npm install -g " + strings.Join(npmPkgs, " ")}).
 		WithMountedDirectory("/WORK/repo", repoDir).
-		WithEnvVariable(secretEnv, token).
-		WithEnvVariable("CI", ciEnv).
+		WithSecretVariable(secretEnv, token).
+		WithEnvVariable("CI", os.Getenv("CI")).
 		WithWorkdir("/WORK/repo")
-	for _, pkg := range npmPkgs {
-		cSemantic = cSemantic.WithExec([]string{fmt.Sprintf("npm install -g %s", pkg)})
+
+	envKeys := make([]string, 0, len(opts.Env))
+	for k := range opts.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		cSemantic = cSemantic.WithEnvVariable(k, opts.Env[k])
 	}
 
-	// Run Release
-	if isDryRun {
-		_, err = cSemantic.WithExec([]string{"npx semantic-release"}).Stderr(ctx)
-	} else {
-		_, err = cSemantic.WithExec([]string{"npx semantic-release --dry-run=false --debug"}).Stderr(ctx)
+	output, err := cSemantic.WithExec([]string{opts.command()}).Stdout(ctx)
+	if err != nil {
+		return
 	}
 
+	result = ParseSemanticReleaseOutput(output)
 	return
 }
+
+// ParseSemanticReleaseOutput extracts the versions and notes from the logs of a semantic-release run.
+func ParseSemanticReleaseOutput(output string) *SemanticReleaseResult {
+	output = ansiRegex.ReplaceAllString(output, "")
+	result := &SemanticReleaseResult{Output: output}
+
+	if m := releaseLastVersionRegex.FindStringSubmatch(output); m != nil {
+		result.LastVersion = m[1]
+	}
+	if m := releaseNextVersionRegex.FindStringSubmatch(output); m != nil {
+		result.NextVersion = m[1]
+	}
+	if m := releasePublishedRegex.FindStringSubmatch(output); m != nil {
+		result.NextVersion = m[1]
+		result.Released = true
+	}
+	if strings.Contains(output, releaseNoChangesSubstring) {
+		result.NextVersion = ""
+		result.Released = false
+	}
+	if loc := releaseNotesHeaderRegex.FindStringIndex(output); loc != nil {
+		result.Notes = strings.TrimSpace(output[loc[1]:])
+	}
+
+	return result
+}
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+var commitSHARegex = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+
+// RepositorySource describes a repository checkout, with what c.Git(...).Tree() can't do:
+// submodules, LFS objects and shallow clones.
+type RepositorySource struct {
+	URL string
+	// Branch, tag or full commit SHA. Defaults to the default branch of the remote.
+	Ref  string
+	Auth *GitAuth
+	// Check out the submodules recursively, with the same auth
+	Submodules bool
+	// Fetch the LFS objects, of the submodules as well
+	LFS bool
+	// Number of commits to fetch, 0 for the full history
+	Depth      int
+	KeepGitDir bool
+}
+
+func (s RepositorySource) depthArgs() []string {
+	if s.Depth <= 0 {
+		return nil
+	}
+	return []string{"--depth", strconv.Itoa(s.Depth)}
+}
+
+// checkoutCommands returns the shell commands completing the checkout in the current directory, after the clone.
+func (s RepositorySource) checkoutCommands() []string {
+	commands := []string{}
+	if s.Submodules {
+		update := append([]string{"git", "submodule", "update", "--init", "--recursive"}, s.depthArgs()...)
+		commands = append(commands, "git submodule sync --recursive", strings.Join(update, " "))
+	}
+	if s.LFS {
+		commands = append(commands, "git lfs install --local", "git lfs pull")
+		if s.Submodules {
+			commands = append(commands, "git submodule foreach --recursive 'git lfs install --local && git lfs pull'")
+		}
+	}
+	return commands
+}
+
+// Directory clones the repository in the container and returns the checkout.
+// The container needs git, and git-lfs when LFS is set.
+func (s RepositorySource) Directory(container *dagger.Container, c *dagger.Client, ctx context.Context) (*dagger.Directory, error) {
+	if s.URL == "" {
+		return nil, fmt.Errorf("ERROR: repository source without URL")
+	}
+	if err := validateGitRef(s.Ref); err != nil {
+		return nil, err
+	}
+	if err := s.Auth.Validate(); err != nil {
+		return nil, err
+	}
+
+	clone := append([]string{"git", "clone"}, s.depthArgs()...)
+	commands := []string{"set -e"}
+	switch {
+	case commitSHARegex.MatchString(s.Ref):
+		// --branch only takes branches and tags, fetch the commit itself
+		clone = append(clone, "--no-checkout", "--", `"$REPO_URL"`, "/SOURCE")
+		fetch := append([]string{"git", "fetch"}, s.depthArgs()...)
+		fetch = append(fetch, "origin", `"$REPO_REF"`)
+		commands = append(commands, strings.Join(clone, " "), "cd /SOURCE", strings.Join(fetch, " "), `git checkout --detach "$REPO_REF"`)
+	case s.Ref != "":
+		clone = append(clone, "--branch", `"$REPO_REF"`, "--", `"$REPO_URL"`, "/SOURCE")
+		commands = append(commands, strings.Join(clone, " "), "cd /SOURCE")
+	default:
+		clone = append(clone, "--", `"$REPO_URL"`, "/SOURCE")
+		commands = append(commands, strings.Join(clone, " "), "cd /SOURCE")
+	}
+	commands = append(commands, s.checkoutCommands()...)
+	if !s.KeepGitDir {
+		// submodules have a .git file pointing into the parent's .git directory
+		commands = append(commands, "find . -name .git -prune -exec rm -rf {} +")
+	}
+
+	ctr := s.Auth.WithGitAuth(s.URL, container.WithEntrypoint([]string{})).
+		WithEnvVariable("REPO_URL", s.URL).
+		WithEnvVariable("REPO_REF", s.Ref).
+		// LFS objects are fetched explicitly afterwards, also when the lfs filters are configured globally
+		WithEnvVariable("GIT_LFS_SKIP_SMUDGE", "1")
+	if !commitSHARegex.MatchString(s.Ref) {
+		// branches move, only a commit can be cached
+		ctr = ctr.WithEnvVariable("CACHE_BUSTER", strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+
+	ctr, err := ctr.WithExec([]string{"sh", "-c", strings.Join(commands, "\n")}).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: could not check out %s: %s", s.URL, err)
+	}
+	return ctr.Directory("/SOURCE"), nil
+}
+
+// PrepareHostRepository checks out the submodules and LFS objects of the repository at path on the host,
+// using the host's git and credentials, so c.Host().Directory sees the complete tree. URL, Ref and Auth are ignored.
+func PrepareHostRepository(ctx context.Context, path string, s RepositorySource) error {
+	for _, command := range s.checkoutCommands() {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Dir = path
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ERROR: '%s' failed; reason: %s: %s", command, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// HostRepositoryDirectory is c.Host().Directory of the repository at path, after PrepareHostRepository.
+func HostRepositoryDirectory(path string, s RepositorySource, c *dagger.Client, ctx context.Context) (*dagger.Directory, error) {
+	if err := PrepareHostRepository(ctx, path, s); err != nil {
+		return nil, err
+	}
+
+	opts := dagger.HostDirectoryOpts{}
+	if !s.KeepGitDir {
+		opts.Exclude = []string{".git", "**/.git"}
+	}
+	return c.Host().Directory(path, opts), nil
+}
@@ -0,0 +1,169 @@
+package pipeline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v56/github"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	// See: https://docs.github.com/en/code-security/code-scanning/integrating-with-code-scanning/sarif-support-for-code-scanning#file-size-limits
+	maxSARIFUploadSize = 10 * 1024 * 1024
+)
+
+var (
+	ErrSARIFProcessingFailed = errors.New("ERROR: code scanning failed to process SARIF upload.")
+)
+
+type sarifDocument struct {
+	Schema  string            `json:"$schema,omitempty"`
+	Version string            `json:"version"`
+	Runs    []json.RawMessage `json:"runs"`
+}
+
+// MergeSARIF combines the runs of several SARIF documents into a single document, so they can be uploaded at once.
+func MergeSARIF(docs ...[]byte) ([]byte, error) {
+	merged := sarifDocument{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []json.RawMessage{},
+	}
+
+	for i, doc := range docs {
+		var d sarifDocument
+		if err := json.Unmarshal(doc, &d); err != nil {
+			return nil, fmt.Errorf("ERROR: cannot parse SARIF document %d: %s", i, err)
+		}
+		if d.Version != "" && d.Version != sarifVersion {
+			return nil, fmt.Errorf("ERROR: unsupported SARIF version in document %d: '%s'", i, d.Version)
+		}
+		merged.Runs = append(merged.Runs, d.Runs...)
+	}
+
+	return json.Marshal(merged)
+}
+
+func MergeSARIFFiles(paths ...string) ([]byte, error) {
+	docs := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		doc, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return MergeSARIF(docs...)
+}
+
+func encodeSARIF(sarif []byte) (string, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(sarif); err != nil {
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
+		return "", err
+	}
+
+	if buf.Len() > maxSARIFUploadSize {
+		return "", fmt.Errorf("ERROR: compressed SARIF is %d bytes, the limit is %d", buf.Len(), maxSARIFUploadSize)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// UploadSARIF publishes SARIF results to code scanning for a commit and ref (e.g. refs/heads/main or refs/pull/1/merge).
+func (gha *GitHubActions) UploadSARIF(ctx context.Context, owner string, repo string, commitSHA string, ref string, sarif []byte) (sarifID string, err error) {
+	if err = RequireTrustedContext("upload SARIF"); err != nil {
+		return
+	}
+
+	encoded, err := encodeSARIF(sarif)
+	if err != nil {
+		return
+	}
+
+	id, _, err := gha.Client.CodeScanning.UploadSarif(ctx, owner, repo, &github.SarifAnalysis{
+		CommitSHA: &commitSHA,
+		Ref:       &ref,
+		Sarif:     &encoded,
+	})
+
+	// the upload is processed asynchronously, and go-github reports "202 Accepted" as an error
+	var accepted *github.AcceptedError
+	if errors.As(err, &accepted) {
+		id = new(github.SarifID)
+		err = json.Unmarshal(accepted.Raw, id)
+	}
+	if err != nil {
+		err = fmt.Errorf("ERROR: could not upload SARIF: %s", err)
+		return
+	}
+
+	sarifID = id.GetID()
+	return
+}
+
+type SARIFUploadStatus struct {
+	ProcessingStatus string   `json:"processing_status"`
+	AnalysesURL      string   `json:"analyses_url"`
+	Errors           []string `json:"errors"`
+}
+
+func (gha *GitHubActions) GetSARIFUploadStatus(ctx context.Context, owner string, repo string, sarifID string) (*SARIFUploadStatus, error) {
+	// go-github's SARIFUpload drops the processing errors, so decode the response ourselves
+	req, err := gha.Client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/code-scanning/sarifs/%s", owner, repo, sarifID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SARIFUploadStatus{}
+	if _, err = gha.Client.Do(ctx, req, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WaitForSARIFProcessing polls the upload until code scanning finished processing it.
+func (gha *GitHubActions) WaitForSARIFProcessing(ctx context.Context, owner string, repo string, sarifID string) (status *SARIFUploadStatus, err error) {
+	err = PollWithBackoff(ctx, 2*time.Second, 30*time.Second, func() (bool, error) {
+		var err error
+		status, err = gha.GetSARIFUploadStatus(ctx, owner, repo, sarifID)
+		if err != nil {
+			// the upload may not be visible right away
+			var errResp *github.ErrorResponse
+			if errors.As(err, &errResp) && errResp.Response.StatusCode == 404 {
+				return false, nil
+			}
+			return false, err
+		}
+		return status.ProcessingStatus != "pending", nil
+	})
+	if err != nil {
+		return
+	}
+
+	if status.ProcessingStatus == "failed" {
+		err = fmt.Errorf("%w %s", ErrSARIFProcessingFailed, strings.Join(status.Errors, "; "))
+	}
+	return
+}
+
+// UploadSARIFAndWait uploads SARIF results and waits for them to be processed, surfacing any processing errors.
+func (gha *GitHubActions) UploadSARIFAndWait(ctx context.Context, owner string, repo string, commitSHA string, ref string, sarif []byte) (*SARIFUploadStatus, error) {
+	sarifID, err := gha.UploadSARIF(ctx, owner, repo, commitSHA, ref, sarif)
+	if err != nil {
+		return nil, err
+	}
+	return gha.WaitForSARIFProcessing(ctx, owner, repo, sarifID)
+}
@@ -0,0 +1,488 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/google/uuid"
+	"golang.org/x/mod/modfile"
+)
+
+type SBOMFormat string
+
+const (
+	SBOMFormatSPDX      SBOMFormat = "spdx"
+	SBOMFormatCycloneDX SBOMFormat = "cyclonedx"
+)
+
+// Labels set by WithSBOM. Dagger can't set manifest annotations yet, so the image config labels carry them.
+const (
+	SBOMPathLabel   = "dev.go-pipeline.sbom.path"
+	SBOMFormatLabel = "dev.go-pipeline.sbom.format"
+	SBOMDigestLabel = "dev.go-pipeline.sbom.digest"
+)
+
+var versionInURLRegex = regexp.MustCompile(`v?\d+\.\d+(\.\d+)?([-+][0-9A-Za-z.-]+)?`)
+
+type SBOMPackage struct {
+	Name    string
+	Version string
+	// Package URL, e.g. pkg:golang/golang.org/x/mod@v0.13.0
+	PURL string
+	// Set for downloaded binaries
+	DownloadURL string
+	SHA256      string
+	// go.sum hash, e.g. h1:...
+	GoSum string
+	// Direct dependency of the main package
+	Direct bool
+}
+
+// SBOM lists the main package (the module, binary or image) and its dependencies.
+type SBOM struct {
+	Main     SBOMPackage
+	Packages []SBOMPackage
+	Created  time.Time
+}
+
+func goPURL(modPath, version string) string {
+	segments := strings.Split(modPath, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	purl := "pkg:golang/" + strings.Join(segments, "/")
+	if version != "" {
+		purl += "@" + url.PathEscape(version)
+	}
+	return purl
+}
+
+// SBOMFromGoModule reads the requirements of the go.mod in dir, with replacements applied and hashes from go.sum.
+func SBOMFromGoModule(dir, version string) (*SBOM, error) {
+	modPath := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(modPath)
+	if err != nil {
+		return nil, err
+	}
+	modFile, err := modfile.Parse(modPath, data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: cannot parse %s: %s", modPath, err)
+	}
+	if modFile.Module == nil {
+		return nil, fmt.Errorf("ERROR: no module directive in: %s", modPath)
+	}
+
+	sums, err := readGoSum(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		return nil, err
+	}
+
+	replaced := map[string]*modfile.Replace{}
+	for _, r := range modFile.Replace {
+		replaced[r.Old.Path+"@"+r.Old.Version] = r
+	}
+
+	sbom := &SBOM{
+		Main:    SBOMPackage{Name: modFile.Module.Mod.Path, Version: version, PURL: goPURL(modFile.Module.Mod.Path, version)},
+		Created: time.Now().UTC(),
+	}
+	for _, req := range modFile.Require {
+		mod := req.Mod
+		r, ok := replaced[mod.Path+"@"+mod.Version]
+		if !ok {
+			r, ok = replaced[mod.Path+"@"]
+		}
+		if ok {
+			if r.New.Version == "" {
+				// local directory replacement, nothing to identify it by
+				continue
+			}
+			mod = r.New
+		}
+
+		sbom.Packages = append(sbom.Packages, SBOMPackage{
+			Name:    mod.Path,
+			Version: mod.Version,
+			PURL:    goPURL(mod.Path, mod.Version),
+			GoSum:   sums[mod.Path+"@"+mod.Version],
+			Direct:  !req.Indirect,
+		})
+	}
+	return sbom, nil
+}
+
+func readGoSum(p string) (map[string]string, error) {
+	sums := map[string]string{}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+"@"+fields[1]] = fields[2]
+	}
+	return sums, scanner.Err()
+}
+
+// SBOMFromBuildInfo converts the module information embedded in a Go binary.
+func SBOMFromBuildInfo(info *debug.BuildInfo) *SBOM {
+	name, version := info.Main.Path, info.Main.Version
+	if name == "" {
+		name = info.Path
+	}
+	if version == "(devel)" {
+		version = ""
+	}
+	sbom := &SBOM{
+		Main:    SBOMPackage{Name: name, Version: version, PURL: goPURL(name, version)},
+		Created: time.Now().UTC(),
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		sbom.Packages = append(sbom.Packages, SBOMPackage{
+			Name:    dep.Path,
+			Version: dep.Version,
+			PURL:    goPURL(dep.Path, dep.Version),
+			GoSum:   dep.Sum,
+		})
+	}
+	sbom.Packages = append(sbom.Packages, SBOMPackage{
+		Name:    "stdlib",
+		Version: info.GoVersion,
+		PURL:    goPURL("stdlib", info.GoVersion),
+		Direct:  true,
+	})
+	return sbom
+}
+
+// SBOMFromGoBinary reads the build information of a Go binary on the host.
+func SBOMFromGoBinary(binaryPath string) (*SBOM, error) {
+	info, err := buildinfo.ReadFile(binaryPath)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: cannot read Go build info of %s: %s", binaryPath, err)
+	}
+	sbom := SBOMFromBuildInfo(info)
+
+	sum, err := sha256File(binaryPath)
+	if err != nil {
+		return nil, err
+	}
+	sbom.Main.SHA256 = sum
+	return sbom, nil
+}
+
+// SBOMFromGoVersionOutput parses the output of `go version -m <binary>` for a single binary.
+func SBOMFromGoVersionOutput(output string) (*SBOM, error) {
+	header, body, _ := strings.Cut(strings.TrimSpace(output), "\n")
+	_, goVersion, ok := strings.Cut(header, ": ")
+	if !ok {
+		return nil, fmt.Errorf("ERROR: unexpected `go version -m` output: '%s'", header)
+	}
+
+	lines := []string{"go\t" + strings.TrimSpace(goVersion)}
+	for _, line := range strings.Split(body, "\n") {
+		lines = append(lines, strings.TrimPrefix(line, "\t"))
+	}
+	info, err := debug.ParseBuildInfo(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: cannot parse `go version -m` output: %s", err)
+	}
+	return SBOMFromBuildInfo(info), nil
+}
+
+// SBOMFromContainerBinary exports a Go binary from the container and reads its build information.
+func SBOMFromContainerBinary(binaryPath string, container *dagger.Container, ctx context.Context) (*SBOM, error) {
+	tmp, err := os.MkdirTemp("", "sbom")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	local := filepath.Join(tmp, path.Base(binaryPath))
+	if _, err = container.File(binaryPath).Export(ctx, local); err != nil {
+		return nil, fmt.Errorf("ERROR: cannot export %s: %s", binaryPath, err)
+	}
+	return SBOMFromGoBinary(local)
+}
+
+// SBOMForBinaries lists the binaries downloaded by WithBinaries, taking the version from the URL when possible.
+func SBOMForBinaries(name, version string, binaries []BinaryBuilder) *SBOM {
+	sbom := &SBOM{
+		Main:    SBOMPackage{Name: name, Version: version, PURL: genericPURL(name, version, "")},
+		Created: time.Now().UTC(),
+	}
+	for _, b := range binaries {
+		pkg := binaryPackage(b.URL)
+		pkg.Direct = true
+		sbom.Packages = append(sbom.Packages, pkg)
+	}
+	return sbom
+}
+
+func binaryPackage(downloadURL string) SBOMPackage {
+	name := path.Base(downloadURL)
+	if i := strings.IndexAny(name, "_."); i > 0 {
+		name = name[:i]
+	}
+	unescaped, err := url.PathUnescape(downloadURL)
+	if err != nil {
+		unescaped = downloadURL
+	}
+	version := versionInURLRegex.FindString(unescaped)
+
+	return SBOMPackage{
+		Name:        name,
+		Version:     version,
+		PURL:        genericPURL(name, version, downloadURL),
+		DownloadURL: downloadURL,
+	}
+}
+
+func genericPURL(name, version, downloadURL string) string {
+	purl := "pkg:generic/" + url.PathEscape(name)
+	if version != "" {
+		purl += "@" + url.PathEscape(version)
+	}
+	if downloadURL != "" {
+		purl += "?download_url=" + url.QueryEscape(downloadURL)
+	}
+	return purl
+}
+
+func (s *SBOM) Encode(format SBOMFormat) ([]byte, error) {
+	switch format {
+	case SBOMFormatSPDX:
+		return s.SPDX()
+	case SBOMFormatCycloneDX:
+		return s.CycloneDX()
+	default:
+		return nil, fmt.Errorf("ERROR: unsupported SBOM format: '%s'", format)
+	}
+}
+
+// SPDX encodes the SBOM as SPDX 2.3 JSON.
+// See: https://spdx.github.io/spdx-spec/v2.3/
+func (s *SBOM) SPDX() ([]byte, error) {
+	type checksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+	type externalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		CopyrightText    string        `json:"copyrightText"`
+		Checksums        []checksum    `json:"checksums,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+		Comment          string        `json:"comment,omitempty"`
+	}
+	type relationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+		Comment            string `json:"comment,omitempty"`
+	}
+
+	toSPDX := func(id string, p SBOMPackage) spdxPackage {
+		pkg := spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+		}
+		if p.DownloadURL != "" {
+			pkg.DownloadLocation = p.DownloadURL
+		}
+		if p.SHA256 != "" {
+			pkg.Checksums = []checksum{{Algorithm: "SHA256", ChecksumValue: p.SHA256}}
+		}
+		if p.PURL != "" {
+			pkg.ExternalRefs = []externalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: p.PURL}}
+		}
+		if p.GoSum != "" {
+			pkg.Comment = "go.sum: " + p.GoSum
+		}
+		return pkg
+	}
+
+	mainID := "SPDXRef-Package-main"
+	packages := []spdxPackage{toSPDX(mainID, s.Main)}
+	relationships := []relationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: mainID}}
+	for i, p := range s.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		packages = append(packages, toSPDX(id, p))
+		// go.mod doesn't tell which module needs an indirect one, so the main package depends on all of them
+		rel := relationship{SPDXElementID: mainID, RelationshipType: "DEPENDS_ON", RelatedSPDXElement: id}
+		if !p.Direct {
+			rel.Comment = "indirect dependency"
+		}
+		relationships = append(relationships, rel)
+	}
+
+	name := s.Main.Name
+	if s.Main.Version != "" {
+		name += "@" + s.Main.Version
+	}
+	doc := map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              name,
+		"documentNamespace": fmt.Sprintf("https://spdx.org/spdxdocs/%s-%s", url.PathEscape(name), uuid.NewString()),
+		"creationInfo": map[string]interface{}{
+			"created":  s.created().Format(time.RFC3339),
+			"creators": []string{"Tool: go-pipeline"},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// CycloneDX encodes the SBOM as CycloneDX 1.5 JSON.
+// See: https://cyclonedx.org/docs/1.5/json/
+func (s *SBOM) CycloneDX() ([]byte, error) {
+	type hash struct {
+		Alg     string `json:"alg"`
+		Content string `json:"content"`
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type externalReference struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}
+	type component struct {
+		Type               string              `json:"type"`
+		BOMRef             string              `json:"bom-ref"`
+		Name               string              `json:"name"`
+		Version            string              `json:"version,omitempty"`
+		PURL               string              `json:"purl,omitempty"`
+		Scope              string              `json:"scope,omitempty"`
+		Hashes             []hash              `json:"hashes,omitempty"`
+		ExternalReferences []externalReference `json:"externalReferences,omitempty"`
+		Properties         []property          `json:"properties,omitempty"`
+	}
+	type dependency struct {
+		Ref       string   `json:"ref"`
+		DependsOn []string `json:"dependsOn,omitempty"`
+	}
+
+	toComponent := func(componentType string, p SBOMPackage) component {
+		comp := component{Type: componentType, BOMRef: p.PURL, Name: p.Name, Version: p.Version, PURL: p.PURL}
+		if comp.BOMRef == "" {
+			comp.BOMRef = p.Name + "@" + p.Version
+		}
+		if p.SHA256 != "" {
+			comp.Hashes = []hash{{Alg: "SHA-256", Content: p.SHA256}}
+		}
+		if p.DownloadURL != "" {
+			comp.ExternalReferences = []externalReference{{Type: "distribution", URL: p.DownloadURL}}
+		}
+		if p.GoSum != "" {
+			comp.Properties = []property{{Name: "go.sum", Value: p.GoSum}}
+		}
+		return comp
+	}
+
+	mainComponent := toComponent("application", s.Main)
+	components := []component{}
+	direct := []string{}
+	for _, p := range s.Packages {
+		comp := toComponent("library", p)
+		if p.DownloadURL != "" {
+			comp.Type = "application"
+		}
+		comp.Scope = "required"
+		components = append(components, comp)
+		direct = append(direct, comp.BOMRef)
+	}
+
+	doc := map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + uuid.NewString(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": s.created().Format(time.RFC3339),
+			"tools": map[string]interface{}{
+				"components": []component{{Type: "application", BOMRef: "go-pipeline", Name: "go-pipeline"}},
+			},
+			"component": mainComponent,
+		},
+		"components":   components,
+		"dependencies": []dependency{{Ref: mainComponent.BOMRef, DependsOn: direct}},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func (s *SBOM) created() time.Time {
+	if s.Created.IsZero() {
+		return time.Now().UTC()
+	}
+	return s.Created.UTC()
+}
+
+// WithSBOM adds the encoded SBOM to the container at sbomPath and labels the image with its location and digest.
+func WithSBOM(sbom *SBOM, format SBOMFormat, sbomPath string, container *dagger.Container) (*dagger.Container, error) {
+	data, err := sbom.Encode(format)
+	if err != nil {
+		return container, err
+	}
+	digest := sha256.Sum256(data)
+
+	return container.
+		WithNewFile(sbomPath, dagger.ContainerWithNewFileOpts{Contents: string(data), Permissions: 0644}).
+		WithLabel(SBOMPathLabel, sbomPath).
+		WithLabel(SBOMFormatLabel, string(format)).
+		WithLabel(SBOMDigestLabel, "sha256:"+hex.EncodeToString(digest[:])), nil
+}
+
+// WithBinariesAndSBOM is WithBinaries, plus an SBOM of the downloaded binaries at sbomPath.
+func WithBinariesAndSBOM(name, version string, binaries []BinaryBuilder, format SBOMFormat, sbomPath string, container *dagger.Container, c *dagger.Client) (*dagger.Container, error) {
+	newContainer, err := WithBinaries(binaries, container, c)
+	if err != nil {
+		return newContainer, err
+	}
+	return WithSBOM(SBOMForBinaries(name, version, binaries), format, sbomPath, newContainer)
+}
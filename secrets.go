@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+var (
+	ErrEmptySecret = errors.New("ERROR: secret is empty.")
+)
+
+// SecretSource describes where a secret comes from. Exactly one of Env, File or Command should be set.
+type SecretSource struct {
+	Env  string
+	File string
+	// Command printing the secret on stdout, e.g. []string{"op", "read", "op://vault/item/token"}
+	Command []string
+}
+
+func (s SecretSource) Secret(name string, c *dagger.Client, ctx context.Context) (*dagger.Secret, error) {
+	switch {
+	case s.Env != "":
+		return SecretFromEnv(name, s.Env, c)
+	case s.File != "":
+		return SecretFromFile(name, s.File, c)
+	case len(s.Command) > 0:
+		return SecretFromCommand(name, s.Command, c, ctx)
+	default:
+		return nil, fmt.Errorf("ERROR: no source configured for secret: %s", name)
+	}
+}
+
+func SecretFromEnv(name, envVar string, c *dagger.Client) (*dagger.Secret, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return nil, fmt.Errorf("%w env var: %s", ErrEmptySecret, envVar)
+	}
+	return c.SetSecret(name, value), nil
+}
+
+// SecretFromFile lets the engine read the file, so the value never passes through this process.
+func SecretFromFile(name, path string, c *dagger.Client) (*dagger.Secret, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: cannot read secret file: %s", err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("%w file: %s", ErrEmptySecret, path)
+	}
+	return c.Host().SetSecretFile(name, path), nil
+}
+
+// SecretFromCommand runs cmd on the host and uses its output, minus the trailing newline, as the secret.
+func SecretFromCommand(name string, cmd []string, c *dagger.Client, ctx context.Context) (*dagger.Secret, error) {
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("ERROR: no command given for secret: %s", name)
+	}
+
+	out, err := exec.CommandContext(ctx, cmd[0], cmd[1:]...).Output()
+	if err != nil {
+		// don't include the output, it may contain the secret
+		return nil, fmt.Errorf("ERROR: secret command '%s' failed: %s", cmd[0], err)
+	}
+
+	value := strings.TrimRight(string(out), "\r\n")
+	if value == "" {
+		return nil, fmt.Errorf("%w command: %s", ErrEmptySecret, cmd[0])
+	}
+	return c.SetSecret(name, value), nil
+}
+
+// NewGitHubActionsFromSecret is NewGitHubActions for a token held in a *dagger.Secret.
+func NewGitHubActionsFromSecret(ctx context.Context, token *dagger.Secret) (*GitHubActions, error) {
+	plaintext, err := token.Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewGitHubActions(ctx, plaintext), nil
+}
+
+// NewGitLabFromSecret is NewGitLab for a token held in a *dagger.Secret.
+func NewGitLabFromSecret(ctx context.Context, baseURL string, token *dagger.Secret) (*GitLab, error) {
+	plaintext, err := token.Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewGitLab(baseURL, plaintext), nil
+}
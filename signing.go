@@ -0,0 +1,423 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Signatures and keys use the minisign format, so they can be checked with `minisign -V` as well.
+// See: https://jedisct1.github.io/minisign/
+
+var (
+	ErrInvalidSignature = errors.New("ERROR: invalid signature.")
+	ErrKeyMismatch      = errors.New("ERROR: signature was made with a different key.")
+	ErrInvalidKey       = errors.New("ERROR: invalid minisign key.")
+	ErrChecksumMismatch = errors.New("ERROR: checksum mismatch.")
+)
+
+const (
+	minisignUntrusted = "untrusted comment: "
+	minisignTrusted   = "trusted comment: "
+
+	// crypto_pwhash_scryptsalsa208sha256 OPSLIMIT/MEMLIMIT_INTERACTIVE
+	minisignOpsLimit = 524288
+	minisignMemLimit = 16777216
+
+	minisignSecretKeySize = 2 + 2 + 2 + 32 + 8 + 8 + 104
+)
+
+var (
+	minisignAlgLegacy    = [2]byte{'E', 'd'}
+	minisignAlgPrehashed = [2]byte{'E', 'D'}
+	minisignKDFScrypt    = [2]byte{'S', 'c'}
+	minisignKDFNone      = [2]byte{0, 0}
+	minisignChecksumAlg  = [2]byte{'B', '2'}
+)
+
+type SigningKey struct {
+	KeyID      [8]byte
+	PrivateKey ed25519.PrivateKey
+}
+
+type VerifyingKey struct {
+	KeyID     [8]byte
+	PublicKey ed25519.PublicKey
+}
+
+// keyIDString formats the key ID the same way minisign does.
+func keyIDString(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+func GenerateSigningKey() (*SigningKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{PrivateKey: priv}
+	if _, err = rand.Read(key.KeyID[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *SigningKey) Public() *VerifyingKey {
+	return &VerifyingKey{
+		KeyID:     k.KeyID,
+		PublicKey: k.PrivateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+func (k *VerifyingKey) MarshalMinisign() []byte {
+	raw := append(append(minisignAlgLegacy[:], k.KeyID[:]...), k.PublicKey...)
+	return []byte(fmt.Sprintf("%sminisign public key %s\n%s\n", minisignUntrusted, keyIDString(k.KeyID), base64.StdEncoding.EncodeToString(raw)))
+}
+
+// ParseMinisignPublicKey accepts a .pub file, or only its base64 line as printed by `minisign -G`.
+func ParseMinisignPublicKey(data []byte) (*VerifyingKey, error) {
+	raw, err := decodeMinisignLine(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || !bytes.Equal(raw[:2], minisignAlgLegacy[:]) {
+		return nil, ErrInvalidKey
+	}
+
+	key := &VerifyingKey{PublicKey: ed25519.PublicKey(raw[10:])}
+	copy(key.KeyID[:], raw[2:10])
+	return key, nil
+}
+
+// MarshalMinisign encodes the key as a minisign secret key file, encrypted unless the password is empty.
+func (k *SigningKey) MarshalMinisign(password string) ([]byte, error) {
+	raw := make([]byte, 0, minisignSecretKeySize)
+	raw = append(raw, minisignAlgLegacy[:]...)
+	if password == "" {
+		raw = append(raw, minisignKDFNone[:]...)
+	} else {
+		raw = append(raw, minisignKDFScrypt[:]...)
+	}
+	raw = append(raw, minisignChecksumAlg[:]...)
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	raw = append(raw, salt...)
+	raw = binary.LittleEndian.AppendUint64(raw, minisignOpsLimit)
+	raw = binary.LittleEndian.AppendUint64(raw, minisignMemLimit)
+
+	keynum := make([]byte, 0, 104)
+	keynum = append(keynum, k.KeyID[:]...)
+	keynum = append(keynum, k.PrivateKey...)
+	checksum := minisignKeyChecksum(k.KeyID, k.PrivateKey)
+	keynum = append(keynum, checksum[:]...)
+
+	if password != "" {
+		if err := minisignXORKey(keynum, password, salt, minisignOpsLimit, minisignMemLimit); err != nil {
+			return nil, err
+		}
+	}
+	raw = append(raw, keynum...)
+
+	comment := "minisign encrypted secret key"
+	if password == "" {
+		comment = "minisign secret key"
+	}
+	return []byte(fmt.Sprintf("%s%s\n%s\n", minisignUntrusted, comment, base64.StdEncoding.EncodeToString(raw))), nil
+}
+
+func ParseMinisignSecretKey(data []byte, password string) (*SigningKey, error) {
+	raw, err := decodeMinisignLine(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != minisignSecretKeySize || !bytes.Equal(raw[:2], minisignAlgLegacy[:]) || !bytes.Equal(raw[4:6], minisignChecksumAlg[:]) {
+		return nil, ErrInvalidKey
+	}
+
+	salt := raw[6:38]
+	opsLimit := binary.LittleEndian.Uint64(raw[38:46])
+	memLimit := binary.LittleEndian.Uint64(raw[46:54])
+	keynum := append([]byte{}, raw[54:]...)
+
+	switch {
+	case bytes.Equal(raw[2:4], minisignKDFScrypt[:]):
+		if password == "" {
+			return nil, fmt.Errorf("%w the key is encrypted, but no password was given", ErrInvalidKey)
+		}
+		if err = minisignXORKey(keynum, password, salt, opsLimit, memLimit); err != nil {
+			return nil, err
+		}
+	case bytes.Equal(raw[2:4], minisignKDFNone[:]):
+	default:
+		return nil, fmt.Errorf("%w unsupported key derivation", ErrInvalidKey)
+	}
+
+	key := &SigningKey{PrivateKey: ed25519.PrivateKey(keynum[8:72])}
+	copy(key.KeyID[:], keynum[:8])
+	checksum := minisignKeyChecksum(key.KeyID, key.PrivateKey)
+	if subtle.ConstantTimeCompare(checksum[:], keynum[72:]) != 1 {
+		return nil, fmt.Errorf("%w wrong password or corrupted key", ErrInvalidKey)
+	}
+	return key, nil
+}
+
+func minisignKeyChecksum(keyID [8]byte, priv ed25519.PrivateKey) [32]byte {
+	data := append(append(minisignAlgLegacy[:], keyID[:]...), priv...)
+	return blake2b.Sum256(data)
+}
+
+// minisignXORKey en/decrypts the secret key in place, deriving the scrypt parameters like libsodium's pickparams.
+func minisignXORKey(keynum []byte, password string, salt []byte, opsLimit, memLimit uint64) error {
+	if opsLimit < 32768 {
+		opsLimit = 32768
+	}
+	r := uint64(8)
+	p := uint64(1)
+	var maxN uint64
+	if opsLimit < memLimit/32 {
+		maxN = opsLimit / (r * 4)
+	} else {
+		maxN = memLimit / (r * 128)
+	}
+	nLog2 := uint(1)
+	for ; nLog2 < 63; nLog2++ {
+		if uint64(1)<<nLog2 > maxN/2 {
+			break
+		}
+	}
+	if opsLimit >= memLimit/32 {
+		maxrp := (opsLimit / 4) / (uint64(1) << nLog2)
+		if maxrp > 0x3fffffff {
+			maxrp = 0x3fffffff
+		}
+		p = maxrp / r
+	}
+
+	stream, err := scrypt.Key([]byte(password), salt, 1<<nLog2, int(r), int(p), len(keynum))
+	if err != nil {
+		return err
+	}
+	for i := range keynum {
+		keynum[i] ^= stream[i]
+	}
+	return nil
+}
+
+// decodeMinisignLine returns the decoded base64 line following the untrusted comment, if any.
+func decodeMinisignLine(data []byte) ([]byte, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, minisignUntrusted) {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s", ErrInvalidKey, err)
+		}
+		return raw, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+func LoadSigningKeyFromFile(path, password string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMinisignSecretKey(data, password)
+}
+
+// LoadSigningKeyFromSecret reads a minisign secret key from a secret. password may be nil for unencrypted keys.
+func LoadSigningKeyFromSecret(key *dagger.Secret, password *dagger.Secret, ctx context.Context) (*SigningKey, error) {
+	data, err := key.Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pw := ""
+	if password != nil {
+		if pw, err = password.Plaintext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return ParseMinisignSecretKey([]byte(data), pw)
+}
+
+func LoadVerifyingKeyFromFile(path string) (*VerifyingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMinisignPublicKey(data)
+}
+
+// Sign returns a prehashed minisign signature of message. The trusted comment is signed as well.
+func (k *SigningKey) Sign(message []byte, trustedComment string) []byte {
+	if strings.ContainsAny(trustedComment, "\r\n") {
+		trustedComment = strings.NewReplacer("\r", " ", "\n", " ").Replace(trustedComment)
+	}
+
+	hash := blake2b.Sum512(message)
+	sig := ed25519.Sign(k.PrivateKey, hash[:])
+	globalSig := ed25519.Sign(k.PrivateKey, append(append([]byte{}, sig...), trustedComment...))
+
+	raw := append(append(minisignAlgPrehashed[:], k.KeyID[:]...), sig...)
+	return []byte(fmt.Sprintf("%ssignature from go-pipeline secret key %s\n%s\n%s%s\n%s\n",
+		minisignUntrusted, keyIDString(k.KeyID),
+		base64.StdEncoding.EncodeToString(raw),
+		minisignTrusted, trustedComment,
+		base64.StdEncoding.EncodeToString(globalSig),
+	))
+}
+
+// Verify checks a minisign signature (prehashed or legacy) of message and returns its trusted comment.
+func (k *VerifyingKey) Verify(message []byte, signature []byte) (trustedComment string, err error) {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], minisignTrusted) {
+		return "", fmt.Errorf("%w malformed signature file", ErrInvalidSignature)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return "", fmt.Errorf("%w malformed signature", ErrInvalidSignature)
+	}
+	if !bytes.Equal(raw[2:10], k.KeyID[:]) {
+		return "", ErrKeyMismatch
+	}
+	sig := raw[10:]
+
+	signed := message
+	switch {
+	case bytes.Equal(raw[:2], minisignAlgPrehashed[:]):
+		hash := blake2b.Sum512(message)
+		signed = hash[:]
+	case bytes.Equal(raw[:2], minisignAlgLegacy[:]):
+	default:
+		return "", fmt.Errorf("%w unsupported signature algorithm", ErrInvalidSignature)
+	}
+	if !ed25519.Verify(k.PublicKey, signed, sig) {
+		return "", ErrInvalidSignature
+	}
+
+	trustedComment = strings.TrimSuffix(strings.TrimPrefix(lines[2], minisignTrusted), "\r")
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || !ed25519.Verify(k.PublicKey, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+		return "", fmt.Errorf("%w trusted comment was modified", ErrInvalidSignature)
+	}
+	return trustedComment, nil
+}
+
+// SignFile writes a detached signature next to path, as path.minisig.
+func SignFile(key *SigningKey, path string) (sigPath string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	comment := fmt.Sprintf("timestamp:%d\tfile:%s\thashed", time.Now().Unix(), filepath.Base(path))
+	sigPath = path + ".minisig"
+	err = os.WriteFile(sigPath, key.Sign(data, comment), 0644)
+	return
+}
+
+func VerifyFile(key *VerifyingKey, path string, sigPath string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	_, err = key.Verify(data, sig)
+	return err
+}
+
+// WriteChecksums writes a `sha256sum` compatible file listing the files by their base name.
+func WriteChecksums(files []string, checksumsPath string) error {
+	var b strings.Builder
+	for _, f := range files {
+		sum, err := sha256File(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, filepath.Base(f))
+	}
+	return os.WriteFile(checksumsPath, []byte(b.String()), 0644)
+}
+
+// SignChecksums writes the checksums of the release artifacts and a detached signature over them.
+// Only the checksums file needs to be verified, the artifacts are covered by their checksums.
+func SignChecksums(key *SigningKey, files []string, checksumsPath string) (sigPath string, err error) {
+	if err = WriteChecksums(files, checksumsPath); err != nil {
+		return
+	}
+	return SignFile(key, checksumsPath)
+}
+
+// VerifyChecksums checks the signature of the checksums file and the artifacts listed in it,
+// which are expected in the same directory.
+func VerifyChecksums(key *VerifyingKey, checksumsPath string, sigPath string) error {
+	if err := VerifyFile(key, checksumsPath, sigPath); err != nil {
+		return err
+	}
+
+	f, err := os.Open(checksumsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(checksumsPath)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		want, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		got, err := sha256File(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("%w file: %s", ErrChecksumMismatch, name)
+		}
+	}
+	return scanner.Err()
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
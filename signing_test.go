@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignFileRoundTrip(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact := filepath.Join(t.TempDir(), "artifact.tar.gz")
+	if err = os.WriteFile(artifact, []byte("release contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sigPath, err := SignFile(key, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyFile(key.Public(), artifact, sigPath); err != nil {
+		t.Fatalf("expected a valid signature: %s", err)
+	}
+
+	// tampered file
+	if err = os.WriteFile(artifact, []byte("release contents!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyFile(key.Public(), artifact, sigPath); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature for a tampered file, got %v", err)
+	}
+
+	other, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyFile(other.Public(), artifact, sigPath); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("expected ErrKeyMismatch for another key, got %v", err)
+	}
+}
+
+func TestSignTrustedComment(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("message")
+	sig := key.Sign(message, "file:message")
+
+	comment, err := key.Public().Verify(message, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != "file:message" {
+		t.Errorf("unexpected trusted comment: %q", comment)
+	}
+
+	// the global signature covers the trusted comment
+	tampered := bytes.Replace(sig, []byte("file:message"), []byte("file:other"), 1)
+	if _, err = key.Public().Verify(message, tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature for a modified trusted comment, got %v", err)
+	}
+}
+
+func TestMinisignKeysRoundTrip(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := ParseMinisignPublicKey(key.Public().MarshalMinisign())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.KeyID != key.KeyID || !pub.PublicKey.Equal(key.Public().PublicKey) {
+		t.Errorf("public key changed in the round trip")
+	}
+
+	for _, password := range []string{"", "correct horse"} {
+		data, err := key.MarshalMinisign(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseMinisignSecretKey(data, password)
+		if err != nil {
+			t.Fatalf("password %q: %s", password, err)
+		}
+		if parsed.KeyID != key.KeyID || !parsed.PrivateKey.Equal(key.PrivateKey) {
+			t.Errorf("password %q: secret key changed in the round trip", password)
+		}
+	}
+
+	encrypted, err := key.MarshalMinisign("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseMinisignSecretKey(encrypted, "wrong"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for a wrong password, got %v", err)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, f := range files {
+		if err = os.WriteFile(f, []byte(filepath.Base(f)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checksums := filepath.Join(dir, "checksums.txt")
+	sigPath, err := SignChecksums(key, files, checksums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyChecksums(key.Public(), checksums, sigPath); err != nil {
+		t.Fatalf("expected valid checksums: %s", err)
+	}
+
+	if err = os.WriteFile(files[1], []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyChecksums(key.Public(), checksums, sigPath)
+	if !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "b") {
+		t.Errorf("expected ErrChecksumMismatch for b, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// See: https://docs.github.com/en/actions/using-workflows/workflow-commands-for-github-actions#step-isolation-and-limits
+	MaxStepSummarySize = 1024 * 1024
+	// GitHub rejects issue/PR comment bodies over 65536 characters.
+	MaxCommentSize = 65536
+
+	truncatedNotice = "\n\n> :warning: Report truncated, see the pipeline logs for the full output.\n"
+)
+
+type ReportStatus string
+
+const (
+	StatusSuccess ReportStatus = "success"
+	StatusFailure ReportStatus = "failure"
+	StatusWarning ReportStatus = "warning"
+	StatusSkipped ReportStatus = "skipped"
+	StatusRunning ReportStatus = "running"
+)
+
+func (s ReportStatus) Emoji() string {
+	switch s {
+	case StatusSuccess:
+		return ":white_check_mark:"
+	case StatusFailure:
+		return ":x:"
+	case StatusWarning:
+		return ":warning:"
+	case StatusSkipped:
+		return ":fast_forward:"
+	case StatusRunning:
+		return ":hourglass_flowing_sand:"
+	default:
+		return ":grey_question:"
+	}
+}
+
+// Report is a small markdown builder shared by job summaries and PR comments,
+// so that pipeline results render the same way everywhere.
+type Report struct {
+	blocks []string
+}
+
+func NewReport(title string) *Report {
+	r := &Report{}
+	if title != "" {
+		r.Heading(2, title)
+	}
+	return r
+}
+
+func (r *Report) Heading(level int, text string) *Report {
+	if level < 1 {
+		level = 1
+	}
+	if level > 6 {
+		level = 6
+	}
+	r.blocks = append(r.blocks, strings.Repeat("#", level)+" "+text)
+	return r
+}
+
+func (r *Report) Paragraph(text string) *Report {
+	r.blocks = append(r.blocks, text)
+	return r
+}
+
+func (r *Report) Status(status ReportStatus, text string) *Report {
+	r.blocks = append(r.blocks, fmt.Sprintf("%s %s", status.Emoji(), text))
+	return r
+}
+
+func (r *Report) List(items ...string) *Report {
+	lines := make([]string, 0, len(items))
+	for _, item := range items {
+		lines = append(lines, "- "+item)
+	}
+	r.blocks = append(r.blocks, strings.Join(lines, "\n"))
+	return r
+}
+
+func (r *Report) Table(headers []string, rows [][]string) *Report {
+	var b strings.Builder
+
+	b.WriteString(tableRow(headers))
+	separators := make([]string, len(headers))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	b.WriteString(tableRow(separators))
+	for _, row := range rows {
+		// pad short rows so the table doesn't break
+		for len(row) < len(headers) {
+			row = append(row, "")
+		}
+		b.WriteString(tableRow(row[:len(headers)]))
+	}
+
+	r.blocks = append(r.blocks, strings.TrimSuffix(b.String(), "\n"))
+	return r
+}
+
+func (r *Report) CodeBlock(lang, code string) *Report {
+	fence := "```"
+	// make sure the fence can't be closed by the code itself
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	r.blocks = append(r.blocks, fmt.Sprintf("%s%s\n%s\n%s", fence, lang, strings.TrimSuffix(code, "\n"), fence))
+	return r
+}
+
+// Details adds a collapsible section. The body is rendered from its own Report.
+func (r *Report) Details(summary string, body *Report) *Report {
+	r.blocks = append(r.blocks, fmt.Sprintf("<details>\n<summary>%s</summary>\n\n%s\n\n</details>", summary, body.String()))
+	return r
+}
+
+func (r *Report) String() string {
+	return strings.Join(r.blocks, "\n\n") + "\n"
+}
+
+// Render returns the markdown, truncated to at most limit bytes. A limit <= 0 means no limit.
+func (r *Report) Render(limit int) string {
+	return truncateMarkdown(r.String(), limit)
+}
+
+func truncateMarkdown(md string, limit int) string {
+	if limit <= 0 || len(md) <= limit {
+		return md
+	}
+
+	cut := limit - len(truncatedNotice)
+	if cut < 0 {
+		return md[:limit]
+	}
+	// prefer cutting at a line boundary, and don't split a UTF-8 rune
+	if i := strings.LastIndex(md[:cut], "\n"); i > 0 {
+		cut = i
+	}
+	for cut > 0 && !isRuneStart(md[cut]) {
+		cut--
+	}
+
+	out := md[:cut]
+	// close an open code fence, otherwise the notice would render as code
+	if strings.Count(out, "\n```")%2 == 1 {
+		out += "\n```"
+	}
+	if strings.Count(out, "<details>") > strings.Count(out, "</details>") {
+		out += "\n</details>"
+	}
+	return truncateIfLonger(out+truncatedNotice, limit)
+}
+
+func truncateIfLonger(s string, limit int) string {
+	if len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func tableRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		cell = strings.ReplaceAll(cell, "|", "\\|")
+		escaped[i] = strings.ReplaceAll(cell, "\n", "<br>")
+	}
+	return "| " + strings.Join(escaped, " | ") + " |\n"
+}
+
+// WriteGitHubStepSummary appends the report to $GITHUB_STEP_SUMMARY. Outside of GitHub Actions it is a no-op.
+func WriteGitHubStepSummary(report *Report) error {
+	summaryPath := os.Getenv("GITHUB_STEP_SUMMARY")
+	if summaryPath == "" {
+		return nil
+	}
+
+	return appendToFile(summaryPath, report.Render(MaxStepSummarySize))
+}
+
+// CommentReportOnPR renders the report as a sticky PR comment, see CommentOrUpdatePR.
+func (gha *GitHubActions) CommentReportOnPR(ctx context.Context, owner string, repo string, prNumber int, report *Report, identifier string) error {
+	// the identifier is kept as an invisible HTML comment so we can find the comment again
+	marker := fmt.Sprintf("<!-- %s -->\n", identifier)
+	body := marker + report.Render(MaxCommentSize-len(marker))
+	return gha.CommentOrUpdatePR(ctx, owner, repo, prNumber, body, identifier)
+}
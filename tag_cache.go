@@ -0,0 +1,245 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// TagCacheStore persists cached tag lists by key.
+type TagCacheStore interface {
+	// Load returns nil data, without an error, on a cache miss.
+	Load(ctx context.Context, key string) ([]byte, error)
+	Save(ctx context.Context, key string, data []byte) error
+}
+
+// FileTagCacheStore keeps one JSON file per key in Dir.
+type FileTagCacheStore struct {
+	Dir string
+}
+
+// NewFileTagCacheStore defaults dir to go-pipeline/tags in the user cache directory.
+func NewFileTagCacheStore(dir string) (*FileTagCacheStore, error) {
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "go-pipeline", "tags")
+	}
+	return &FileTagCacheStore{Dir: dir}, nil
+}
+
+func (s *FileTagCacheStore) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, key+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *FileTagCacheStore) Save(ctx context.Context, key string, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	// write and rename, so concurrent runs never read a partial file
+	tmp, err := os.CreateTemp(s.Dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, key+".json"))
+}
+
+// VolumeTagCacheStore keeps the cache in a Dagger cache volume, for runs on the same engine.
+type VolumeTagCacheStore struct {
+	Volume *dagger.CacheVolume
+	// Any image with a shell, defaults to docker.io/alpine:3.18
+	Image  string
+	client *dagger.Client
+}
+
+func NewVolumeTagCacheStore(volumeName string, c *dagger.Client) *VolumeTagCacheStore {
+	return &VolumeTagCacheStore{Volume: c.CacheVolume(volumeName), client: c}
+}
+
+func (s *VolumeTagCacheStore) container() *dagger.Container {
+	image := s.Image
+	if image == "" {
+		image = "docker.io/alpine:3.18"
+	}
+	return s.client.Container().From(image).
+		WithMountedCache("/cache", s.Volume).
+		// the volume changes outside of the engine's knowledge, never reuse a cached exec
+		WithEnvVariable("CACHE_BUSTER", strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+func (s *VolumeTagCacheStore) Load(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.container().
+		WithExec([]string{"sh", "-c", fmt.Sprintf("cat '/cache/%s.json' 2>/dev/null || true", key)}).
+		Stdout(ctx)
+	if err != nil || out == "" {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+func (s *VolumeTagCacheStore) Save(ctx context.Context, key string, data []byte) error {
+	_, err := s.container().
+		WithNewFile("/tmp/"+key+".json", dagger.ContainerWithNewFileOpts{Contents: string(data)}).
+		WithExec([]string{"mv", "/tmp/" + key + ".json", "/cache/" + key + ".json"}).
+		Sync(ctx)
+	return err
+}
+
+type tagCacheEntry struct {
+	RepoURL string    `json:"repoURL"`
+	Query   string    `json:"query"`
+	Fetched time.Time `json:"fetched"`
+	Tags    []GitTag  `json:"tags"`
+}
+
+// TagCache caches tag lookups by repo URL and query.
+type TagCache struct {
+	Store TagCacheStore
+	// Entries older than TTL are fetched again, zero never expires.
+	TTL time.Duration
+	// Ignore cached entries, still updating them.
+	ForceRefresh bool
+}
+
+func tagCacheKey(repoURL, query string) string {
+	sum := sha256.Sum256([]byte(repoURL + "\x00" + query))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Tags returns the cached tags for repoURL and query, calling fetch on a miss or expired entry.
+// query identifies the lookup, e.g. the ref and TagQuery it is made with.
+// The cache is best effort: store errors are logged, and a nil cache or store always fetches.
+func (tc *TagCache) Tags(ctx context.Context, repoURL string, query interface{}, fetch func() ([]GitTag, error)) ([]GitTag, error) {
+	if tc == nil || tc.Store == nil {
+		return fetch()
+	}
+
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	key := tagCacheKey(repoURL, string(queryJSON))
+
+	if !tc.ForceRefresh {
+		data, err := tc.Store.Load(ctx, key)
+		if err != nil {
+			log.Printf("WARNING: cannot read tag cache: %s", err)
+		}
+		entry := tagCacheEntry{}
+		if data != nil && json.Unmarshal(data, &entry) == nil && entry.RepoURL == repoURL && entry.Query == string(queryJSON) {
+			if tc.TTL == 0 || time.Since(entry.Fetched) < tc.TTL {
+				return entry.Tags, nil
+			}
+		}
+	}
+
+	tags, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(tagCacheEntry{RepoURL: repoURL, Query: string(queryJSON), Fetched: time.Now().UTC(), Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	if err = tc.Store.Save(ctx, key, data); err != nil {
+		log.Printf("WARNING: cannot write tag cache: %s", err)
+	}
+	return tags, nil
+}
+
+func tagNames(tags []GitTag) []string {
+	names := make([]string, 0, len(tags))
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func namesToTags(names []string) []GitTag {
+	tags := make([]GitTag, 0, len(names))
+	for _, n := range names {
+		tags = append(tags, GitTag{Tag: n, Name: n, Version: tagVersion(n, "")})
+	}
+	return tags
+}
+
+// ListRemoteTags is the cached ListRemoteTags.
+func (tc *TagCache) ListRemoteTags(ctx context.Context, repoURL string, query TagQuery) ([]GitTag, error) {
+	return tc.Tags(ctx, repoURL, query, func() ([]GitTag, error) {
+		return ListRemoteTags(ctx, repoURL, query)
+	})
+}
+
+// GetRemoteGitTags is the cached GetRemoteGitTags.
+func (tc *TagCache) GetRemoteGitTags(ctx context.Context, repoURL string) ([]string, error) {
+	tags, err := tc.ListRemoteTags(ctx, repoURL, TagQuery{Prefix: "v", SemverOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return tagNames(tags), nil
+}
+
+// GetGitTags is the cached GetGitTags.
+func (tc *TagCache) GetGitTags(repoURL, ref string, container *dagger.Container, c *dagger.Client, ctx context.Context) ([]string, error) {
+	query := map[string]string{"func": "GetGitTags", "ref": ref}
+	tags, err := tc.Tags(ctx, repoURL, query, func() ([]GitTag, error) {
+		names, err := GetGitTags(repoURL, ref, container, c, ctx)
+		return namesToTags(names), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tagNames(tags), nil
+}
+
+// GetLatestGitTag is the cached GetLatestGitTag.
+func (tc *TagCache) GetLatestGitTag(repoURL, ref string, container *dagger.Container, c *dagger.Client, ctx context.Context) (string, error) {
+	tags, err := tc.GetGitTags(repoURL, ref, container, c, ctx)
+	if err != nil {
+		return "", err
+	}
+	return ResolveLatestVersion(tags, VersionSelector{})
+}
+
+// NewTagCacheFromEnv returns a file backed cache in GO_PIPELINE_TAG_CACHE_DIR, or the user cache directory.
+// GO_PIPELINE_TAG_CACHE_TTL (e.g. "30m") overrides the ttl, and setting GO_PIPELINE_TAG_CACHE_REFRESH forces a refresh.
+func NewTagCacheFromEnv(ttl time.Duration) (*TagCache, error) {
+	store, err := NewFileTagCacheStore(os.Getenv("GO_PIPELINE_TAG_CACHE_DIR"))
+	if err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("GO_PIPELINE_TAG_CACHE_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("ERROR: invalid GO_PIPELINE_TAG_CACHE_TTL: %s", err)
+		}
+	}
+	refresh := strings.TrimSpace(os.Getenv("GO_PIPELINE_TAG_CACHE_REFRESH"))
+	return &TagCache{Store: store, TTL: ttl, ForceRefresh: refresh != "" && refresh != "0" && refresh != "false"}, nil
+}
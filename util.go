@@ -1,10 +1,17 @@
 package pipeline
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // SliceToKeyMap returns a map with the given keys and a true value.
@@ -52,3 +59,84 @@ func WalkMatch(root, pattern string) ([]string, error) {
 	}
 	return matches, nil
 }
+
+// PollWithBackoff calls poll until it reports done, an error occurs, or ctx is cancelled.
+// The delay between calls starts at initial and doubles up to maxDelay.
+func PollWithBackoff(ctx context.Context, initial, maxDelay time.Duration, poll func() (done bool, err error)) error {
+	delay := initial
+	for {
+		done, err := poll()
+		if err != nil || done {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("ERROR: %s %s: %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// DoJSONRequest sends in (if not nil) as JSON and decodes the response into out (if not nil).
+// Non-2xx responses are returned as errors including the response body.
+func DoJSONRequest(ctx context.Context, client *http.Client, method, url string, headers map[string]string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &HTTPError{Method: method, URL: url, StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(msg))}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
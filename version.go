@@ -0,0 +1,383 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+	"golang.org/x/mod/semver"
+)
+
+var (
+	ErrNotConventionalCommit = errors.New("ERROR: commit message does not follow Conventional Commits.")
+
+	// See: https://www.conventionalcommits.org/en/v1.0.0/#specification
+	conventionalHeaderRegex = regexp.MustCompile(`^(\w+)(?:\(([^()\r\n]+)\))?(!)?: (.+)$`)
+	conventionalFooterRegex = regexp.MustCompile(`^(BREAKING[ -]CHANGE|[\w-]+)(?:: | #)(.*)$`)
+)
+
+type CommitFooter struct {
+	Token string
+	Value string
+}
+
+type ConventionalCommit struct {
+	Hash        string
+	AuthorName  string
+	AuthorEmail string
+	// First line of the message
+	Header   string
+	Type     string
+	Scope    string
+	Subject  string
+	Body     string
+	Footers  []CommitFooter
+	Breaking bool
+	// Text of the BREAKING CHANGE footer, or the subject when only `!` was used.
+	BreakingNote string
+	// Message as written, including footers.
+	Message string
+}
+
+// ParseConventionalCommit parses a commit message. Non-conventional messages are returned with an
+// empty Type alongside ErrNotConventionalCommit.
+func ParseConventionalCommit(message string) (ConventionalCommit, error) {
+	message = strings.TrimSpace(strings.ReplaceAll(message, "\r\n", "\n"))
+	header, rest, _ := strings.Cut(message, "\n")
+
+	commit := ConventionalCommit{
+		Header:  header,
+		Subject: header,
+		Message: message,
+	}
+
+	m := conventionalHeaderRegex.FindStringSubmatch(header)
+	if m == nil {
+		commit.Body = strings.TrimSpace(rest)
+		return commit, ErrNotConventionalCommit
+	}
+	commit.Type = strings.ToLower(m[1])
+	commit.Scope = m[2]
+	commit.Breaking = m[3] == "!"
+	commit.Subject = m[4]
+
+	commit.Body, commit.Footers = splitFooters(strings.TrimSpace(rest))
+	for _, footer := range commit.Footers {
+		if footer.Token == "BREAKING CHANGE" || footer.Token == "BREAKING-CHANGE" {
+			commit.Breaking = true
+			commit.BreakingNote = footer.Value
+		}
+	}
+	if commit.Breaking && commit.BreakingNote == "" {
+		commit.BreakingNote = commit.Subject
+	}
+
+	return commit, nil
+}
+
+// splitFooters separates the trailing footer paragraph from the body. Footer values may span several lines.
+func splitFooters(text string) (body string, footers []CommitFooter) {
+	if text == "" {
+		return
+	}
+
+	paragraphs := strings.Split(text, "\n\n")
+	last := paragraphs[len(paragraphs)-1]
+	lines := strings.Split(last, "\n")
+	if !conventionalFooterRegex.MatchString(lines[0]) {
+		return text, nil
+	}
+
+	for _, line := range lines {
+		if m := conventionalFooterRegex.FindStringSubmatch(line); m != nil {
+			footers = append(footers, CommitFooter{Token: m[1], Value: m[2]})
+			continue
+		}
+		footers[len(footers)-1].Value += "\n" + line
+	}
+
+	body = strings.TrimSpace(strings.Join(paragraphs[:len(paragraphs)-1], "\n\n"))
+	return
+}
+
+type ReleaseType int
+
+const (
+	ReleaseNone ReleaseType = iota
+	ReleasePatch
+	ReleaseMinor
+	ReleaseMajor
+)
+
+func (r ReleaseType) String() string {
+	switch r {
+	case ReleasePatch:
+		return "patch"
+	case ReleaseMinor:
+		return "minor"
+	case ReleaseMajor:
+		return "major"
+	default:
+		return "none"
+	}
+}
+
+type VersionOptions struct {
+	// Commit types triggering a minor release, defaults to "feat".
+	MinorTypes []string
+	// Commit types triggering a patch release, defaults to "fix" and "perf".
+	PatchTypes []string
+	// Prerelease channel, e.g. "rc" or "beta". Versions look like v1.2.0-rc.3.
+	Channel string
+	// Version of the first release, defaults to v1.0.0.
+	InitialVersion string
+	// Prefix of the release tags, e.g. "ci/" for the Go submodule in ci/ (tags like ci/v1.2.0).
+	TagPrefix string
+	// Only consider commits touching these git pathspecs, e.g. "ci" or ":(exclude)ci".
+	Paths []string
+}
+
+func (o VersionOptions) withDefaults() VersionOptions {
+	if o.MinorTypes == nil {
+		o.MinorTypes = []string{"feat"}
+	}
+	if o.PatchTypes == nil {
+		o.PatchTypes = []string{"fix", "perf"}
+	}
+	if o.InitialVersion == "" {
+		o.InitialVersion = "v1.0.0"
+	}
+	return o
+}
+
+func (o VersionOptions) releaseType(commit ConventionalCommit) ReleaseType {
+	switch {
+	case commit.Breaking:
+		return ReleaseMajor
+	case SliceToKeyMap(o.MinorTypes)[commit.Type]:
+		return ReleaseMinor
+	case SliceToKeyMap(o.PatchTypes)[commit.Type]:
+		return ReleasePatch
+	default:
+		return ReleaseNone
+	}
+}
+
+type VersionResult struct {
+	// Next version, or the current one when nothing is released.
+	Version         string
+	PreviousVersion string
+	// Version with the tag prefix, e.g. ci/v1.2.0
+	Tag         string
+	ReleaseType ReleaseType
+	NewRelease  bool
+	// Commits since PreviousVersion, newest first.
+	Commits []ConventionalCommit
+}
+
+// ComputeNextVersion works out the next version from the existing semver tags (with a "v" prefix)
+// and the commits since the latest stable one of them.
+func ComputeNextVersion(tags []string, commits []ConventionalCommit, opts VersionOptions) (*VersionResult, error) {
+	opts = opts.withDefaults()
+	if !semver.IsValid(opts.InitialVersion) {
+		return nil, fmt.Errorf("ERROR: invalid initial version: '%s'", opts.InitialVersion)
+	}
+
+	result := &VersionResult{
+		PreviousVersion: latestStableVersion(tags),
+		Commits:         commits,
+	}
+	for _, commit := range commits {
+		if rt := opts.releaseType(commit); rt > result.ReleaseType {
+			result.ReleaseType = rt
+		}
+	}
+
+	if result.ReleaseType == ReleaseNone {
+		result.Version = result.PreviousVersion
+		return result, nil
+	}
+
+	next := opts.InitialVersion
+	if result.PreviousVersion != "" {
+		next = bumpVersion(result.PreviousVersion, result.ReleaseType)
+	}
+	if opts.Channel != "" {
+		next = nextPrerelease(next, opts.Channel, tags)
+	}
+
+	result.Version = next
+	result.NewRelease = true
+	return result, nil
+}
+
+// isChannelVersion reports whether version belongs to the prerelease channel, or is stable for an empty channel.
+func isChannelVersion(version, channel string) bool {
+	if channel == "" {
+		return semver.Prerelease(version) == ""
+	}
+	return strings.HasPrefix(semver.Prerelease(version), "-"+channel+".")
+}
+
+func latestStableVersion(tags []string) (latest string) {
+	for _, tag := range tags {
+		if !semver.IsValid(tag) || semver.Prerelease(tag) != "" {
+			continue
+		}
+		if latest == "" || semver.Compare(tag, latest) > 0 {
+			latest = tag
+		}
+	}
+	return
+}
+
+func bumpVersion(version string, releaseType ReleaseType) string {
+	major, minor, patch := semverParts(version)
+	switch releaseType {
+	case ReleaseMajor:
+		return fmt.Sprintf("v%d.0.0", major+1)
+	case ReleaseMinor:
+		return fmt.Sprintf("v%d.%d.0", major, minor+1)
+	case ReleasePatch:
+		return fmt.Sprintf("v%d.%d.%d", major, minor, patch+1)
+	default:
+		return semver.Canonical(version)
+	}
+}
+
+// nextPrerelease returns version-channel.N, with N one past the highest existing tag for that channel.
+func nextPrerelease(version, channel string, tags []string) string {
+	prefix := fmt.Sprintf("%s-%s.", version, channel)
+	n := 0
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		if i, err := strconv.Atoi(strings.TrimPrefix(tag, prefix)); err == nil && i > n {
+			n = i
+		}
+	}
+	return fmt.Sprintf("%s%d", prefix, n+1)
+}
+
+// semverParts returns the numeric components of a valid semver string.
+func semverParts(version string) (major, minor, patch int) {
+	canonical := strings.TrimPrefix(semver.Canonical(version), "v")
+	canonical, _, _ = strings.Cut(canonical, "-")
+	canonical, _, _ = strings.Cut(canonical, "+")
+
+	parts := strings.Split(canonical, ".")
+	major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	if len(parts) > 2 {
+		patch, _ = strconv.Atoi(parts[2])
+	}
+	return
+}
+
+const (
+	gitFieldSep  = "\x1f"
+	gitRecordSep = "\x1e"
+)
+
+// GetCommits returns the commits in revRange (e.g. "v1.2.0..HEAD"), newest first. Extra arguments are
+// passed to `git log`, e.g. "--", "path/".
+func GetCommits(repoDir *dagger.Directory, revRange string, container *dagger.Container, c *dagger.Client, ctx context.Context, logArgs ...string) (commits []ConventionalCommit, err error) {
+	args := []string{"git", "log", "--format=%H%x1f%an%x1f%ae%x1f%B%x1e", revRange}
+	output, err := gitOutput(repoDir, container, ctx, append(args, logArgs...)...)
+	if err != nil {
+		return
+	}
+
+	for _, record := range strings.Split(output, gitRecordSep) {
+		fields := strings.SplitN(strings.TrimSpace(record), gitFieldSep, 4)
+		if len(fields) != 4 {
+			continue
+		}
+		commit, _ := ParseConventionalCommit(fields[3])
+		commit.Hash = fields[0]
+		commit.AuthorName = fields[1]
+		commit.AuthorEmail = fields[2]
+		commits = append(commits, commit)
+	}
+	return
+}
+
+// CalculateNextVersion is a Go-native replacement for the version calculation done by RunSemanticRelease.
+// repoDir must contain the .git directory with the full history and tags, and the container needs git.
+func CalculateNextVersion(repoDir *dagger.Directory, opts VersionOptions, container *dagger.Container, c *dagger.Client, ctx context.Context) (result *VersionResult, err error) {
+	tagPattern := opts.TagPrefix + "v*"
+	output, err := gitOutput(repoDir, container, ctx, "git", "tag", "--merged", "HEAD", "--list", tagPattern)
+	if err != nil {
+		return
+	}
+	tags := stripTagPrefix(splitLines(output), opts.TagPrefix)
+
+	// HEAD is already released, nothing to do
+	output, err = gitOutput(repoDir, container, ctx, "git", "tag", "--points-at", "HEAD", "--list", tagPattern)
+	if err != nil {
+		return
+	}
+	for _, tag := range stripTagPrefix(splitLines(output), opts.TagPrefix) {
+		if semver.IsValid(tag) && isChannelVersion(tag, opts.Channel) {
+			return &VersionResult{Version: tag, PreviousVersion: tag, Tag: opts.TagPrefix + tag}, nil
+		}
+	}
+
+	revRange := "HEAD"
+	if latest := latestStableVersion(tags); latest != "" {
+		revRange = opts.TagPrefix + latest + "..HEAD"
+	}
+	var logArgs []string
+	if len(opts.Paths) > 0 {
+		logArgs = append([]string{"--"}, opts.Paths...)
+	}
+	commits, err := GetCommits(repoDir, revRange, container, c, ctx, logArgs...)
+	if err != nil {
+		return
+	}
+
+	result, err = ComputeNextVersion(tags, commits, opts)
+	if err == nil && result.Version != "" {
+		result.Tag = opts.TagPrefix + result.Version
+	}
+	return
+}
+
+func stripTagPrefix(tags []string, prefix string) []string {
+	stripped := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			stripped = append(stripped, strings.TrimPrefix(tag, prefix))
+		}
+	}
+	return stripped
+}
+
+func gitOutput(repoDir *dagger.Directory, container *dagger.Container, ctx context.Context, args ...string) (string, error) {
+	output, err := container.
+		WithMountedDirectory("/REPO", repoDir).
+		WithWorkdir("/REPO").
+		WithExec(args).
+		Stdout(ctx)
+	if err != nil {
+		err = fmt.Errorf("ERROR: '%s' failed; reason: %s", strings.Join(args, " "), err)
+	}
+	return output, err
+}
+
+func splitLines(output string) (lines []string) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"strings"
 
 	"dagger.io/dagger"
 )
@@ -126,13 +127,16 @@ type BinaryBuilder struct {
 }
 
 func WithBinaries(binaries []BinaryBuilder, container *dagger.Container, c *dagger.Client) (newContainer *dagger.Container, err error) {
+	newContainer = container
 	for _, binary := range binaries {
-		newContainer, err = ContainerWithBinary(c, container, binary.URL)
+		newContainer, err = ContainerWithBinary(c, newContainer, binary.URL)
 		if err != nil {
 			err = fmt.Errorf("ERROR: cannot add binary, reason: %s", err)
 			return newContainer, err
 		}
-		newContainer.WithExec(binary.CheckCommand)
+		if len(binary.CheckCommand) > 0 {
+			newContainer = newContainer.WithExec(binary.CheckCommand)
+		}
 	}
 
 	return
@@ -167,9 +171,17 @@ func ContainerWithBinary(c *dagger.Client, container *dagger.Container, download
 	return ContainerWithBinaryAtPath(c, container, downloadURL, binPath)
 }
 
+// binaryDownloadPath is where ContainerWithBinaryAtPath puts the downloaded file.
+func binaryDownloadPath(downloadURL string, path string) string {
+	if filepath.Ext(downloadURL) == "" {
+		return filepath.Join(path, filepath.Base(downloadURL))
+	}
+	return filepath.Join("/download", filepath.Base(downloadURL))
+}
+
 func ContainerWithBinaryAtPath(c *dagger.Client, container *dagger.Container, downloadURL string, path string) (*dagger.Container, error) {
 	fName := filepath.Base(downloadURL)
-	tmpDest := filepath.Join("/download", fName)
+	tmpDest := binaryDownloadPath(downloadURL, path)
 
 	switch filepath.Ext(downloadURL) {
 	case ".gz":
@@ -179,10 +191,50 @@ func ContainerWithBinaryAtPath(c *dagger.Client, container *dagger.Container, do
 		container = ContainerWithDownloadFile(downloadURL, tmpDest, container)
 		container = container.WithExec([]string{"unzip", tmpDest, "-d", path})
 	case "":
-		container = container.WithFile(filepath.Join(path, fName), c.HTTP(downloadURL), dagger.ContainerWithFileOpts{Permissions: 0750})
+		container = container.WithFile(tmpDest, c.HTTP(downloadURL), dagger.ContainerWithFileOpts{Permissions: 0750})
 	default:
 		return container, fmt.Errorf("ERROR: unsupported container extension for file: %s", fName)
 	}
 
 	return container, nil
 }
+
+// ContainerWithBinaryAtPath is ContainerWithBinaryAtPath recording the binary and its sha256 digest.
+// The download runs right away, so only binaries that were actually fetched are recorded. The container needs sha256sum.
+func (r *ToolRecorder) ContainerWithBinaryAtPath(c *dagger.Client, container *dagger.Container, downloadURL string, path string, ctx context.Context) (*dagger.Container, error) {
+	container, err := ContainerWithBinaryAtPath(c, container, downloadURL, path)
+	if err != nil {
+		return container, err
+	}
+
+	output, err := container.WithExec([]string{"sha256sum", binaryDownloadPath(downloadURL, path)}).Stdout(ctx)
+	if err != nil {
+		return container, fmt.Errorf("ERROR: could not download %s: %s", downloadURL, err)
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(output), " ")
+
+	pkg := binaryPackage(downloadURL)
+	r.Record(ResolvedTool{Name: pkg.Name, Version: pkg.Version, URL: downloadURL, SHA256: sum})
+	return container, nil
+}
+
+func (r *ToolRecorder) ContainerWithBinary(c *dagger.Client, container *dagger.Container, downloadURL string, ctx context.Context) (*dagger.Container, error) {
+	return r.ContainerWithBinaryAtPath(c, container, downloadURL, "/usr/local/bin", ctx)
+}
+
+// WithBinaries is WithBinaries recording every binary.
+func (r *ToolRecorder) WithBinaries(binaries []BinaryBuilder, container *dagger.Container, c *dagger.Client, ctx context.Context) (newContainer *dagger.Container, err error) {
+	newContainer = container
+	for _, binary := range binaries {
+		newContainer, err = r.ContainerWithBinary(c, newContainer, binary.URL, ctx)
+		if err != nil {
+			err = fmt.Errorf("ERROR: cannot add binary, reason: %s", err)
+			return newContainer, err
+		}
+		if len(binary.CheckCommand) > 0 {
+			newContainer = newContainer.WithExec(binary.CheckCommand)
+		}
+	}
+
+	return
+}